@@ -16,7 +16,6 @@ package main
 import (
 	skype "github.com/kelaresg/go-skypeapi"
 	"strings"
-	"time"
 )
 
 func (handler *CommandHandler) CommandSpecialMux(ce *CommandEvent) {
@@ -72,7 +71,7 @@ func (handler *CommandHandler) CommandSpecialCreate(ce *CommandEvent) {
 	}
 
 	handler.log.Debugln("Create Group", topic, "with", members)
-	err := user.Conn.HandleGroupCreate(members)
+	conversationId, err := user.createSkypeGroup(members)
 	inputArr := strings.Split(ce.Args[1], ",")
 	members = skype.Members{}
 	for _, memberId := range inputArr {
@@ -81,16 +80,15 @@ func (handler *CommandHandler) CommandSpecialCreate(ce *CommandEvent) {
 			Role: "Admin",
 		})
 	}
-	conversationId, ok := <-user.Conn.CreateChan
-	if ok {
-		err = user.Conn.AddMember(members, conversationId)
+	if err != nil {
+		ce.Reply("Failed to create group: %v", err)
+		return
 	}
+	err = user.Conn.AddMember(members, conversationId)
 	if err != nil {
 		ce.Reply("Please confirm that parameters is correct.")
 	} else {
-		ce.Reply("Syncing group list...")
-		time.Sleep(time.Duration(3) * time.Second)
-		ce.Reply("Syncing group list completed")
+		ce.Reply("Successfully created Skype group %s", conversationId)
 	}
 }
 
@@ -13,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"maunium.net/go/maulogger/v2"
 
@@ -43,6 +44,7 @@ type CommandEvent struct {
 	Portal  *Portal
 	Handler *CommandHandler
 	RoomID  id.RoomID
+	EventID id.EventID
 	User    *User
 	Command string
 	Args    []string
@@ -62,19 +64,100 @@ func (ce *CommandEvent) Reply(msg string, args ...interface{}) {
 	}
 }
 
+// CommandState is an interactive command that is waiting for the next message of the user in a room,
+// e.g. the password step of login.
+type CommandState struct {
+	RoomID id.RoomID
+	Action string
+	// Prompt asks for the reply. It's repeated if the user runs another command in the meantime.
+	Prompt string
+	Next   func(ce *CommandEvent, text string)
+
+	timer *time.Timer
+}
+
+const commandStateTimeout = 3 * time.Minute
+
+// SetCommandState replaces the interactive command of the user. The state is cleared and the user
+// is notified if no reply arrives within commandStateTimeout. Passing nil cancels the current state.
+func (user *User) SetCommandState(ce *CommandEvent, state *CommandState) {
+	user.commandStateLock.Lock()
+	defer user.commandStateLock.Unlock()
+	if user.commandState != nil {
+		user.commandState.timer.Stop()
+	}
+	user.commandState = state
+	if state == nil {
+		return
+	}
+	state.timer = time.AfterFunc(commandStateTimeout, func() {
+		user.commandStateLock.Lock()
+		timedOut := user.commandState == state
+		if timedOut {
+			user.commandState = nil
+		}
+		user.commandStateLock.Unlock()
+		if timedOut {
+			ce.Reply("%s timed out.", state.Action)
+		}
+	})
+}
+
+// GetCommandState returns the interactive command that is waiting for a message in the given room, if any.
+func (user *User) GetCommandState(roomID id.RoomID) *CommandState {
+	user.commandStateLock.Lock()
+	defer user.commandStateLock.Unlock()
+	if user.commandState != nil && user.commandState.RoomID == roomID {
+		return user.commandState
+	}
+	return nil
+}
+
 // Handle handles messages to the bridge
-func (handler *CommandHandler) Handle(roomID id.RoomID, user *User, message string) {
+func (handler *CommandHandler) Handle(roomID id.RoomID, eventID id.EventID, user *User, message string) {
+	if state := user.GetCommandState(roomID); state != nil {
+		ce := &CommandEvent{
+			Bot:     handler.bridge.Bot,
+			Bridge:  handler.bridge,
+			Handler: handler,
+			RoomID:  roomID,
+			EventID: eventID,
+			User:    user,
+			Command: state.Action,
+		}
+		command, isCommand := handler.commandInReply(roomID, user, message)
+		if strings.ToLower(strings.TrimSpace(message)) == "cancel" || (isCommand && strings.ToLower(command) == "cancel") {
+			user.SetCommandState(nil, nil)
+			ce.Reply("%s cancelled.", state.Action)
+			return
+		} else if !isCommand {
+			handler.log.Debugfln("%s sent a reply to %s in %s", user.MXID, state.Action, roomID)
+			state.Next(ce, message)
+			return
+		}
+		// Other commands still work, but remind the user of the step that's waiting for a reply
+		defer func() {
+			if user.GetCommandState(roomID) == state {
+				ce.Reply("%s is still waiting for a reply. %s", state.Action, state.Prompt)
+			}
+		}()
+		message = command
+	}
 	args := strings.Fields(message)
+	if len(args) == 0 {
+		return
+	}
 	ce := &CommandEvent{
 		Bot:     handler.bridge.Bot,
 		Bridge:  handler.bridge,
 		Handler: handler,
 		RoomID:  roomID,
+		EventID: eventID,
 		User:    user,
 		Command: strings.ToLower(args[0]),
 		Args:    args[1:],
 	}
-	if ce.Command == "login" {
+	if ce.Command == "login" || ce.Command == "login-matrix" {
 		message = ""
 	}
 	handler.log.Debugfln("%s sent '%s' in %s", user.MXID, message, roomID)
@@ -85,14 +168,41 @@ func (handler *CommandHandler) Handle(roomID id.RoomID, user *User, message stri
 	}
 }
 
+// commandInReply returns the command in a message that was sent while an interactive command is waiting for
+// a reply, or false if the message is the reply. Messages with the command prefix are commands, and so are
+// bare command names like help in the management room. Anything else is passed to the interactive command.
+func (handler *CommandHandler) commandInReply(roomID id.RoomID, user *User, message string) (string, bool) {
+	message = strings.TrimSpace(message)
+	commandPrefix := handler.bridge.Config.Bridge.CommandPrefix
+	if len(commandPrefix) > 0 && strings.HasPrefix(message, commandPrefix) {
+		return strings.TrimLeft(message[len(commandPrefix):], " "), true
+	} else if roomID == user.ManagementRoom && isCommandName(message) {
+		return message, true
+	}
+	return "", false
+}
+
+// isCommandName checks if the text is the name of a command listed by help.
+func isCommandName(text string) bool {
+	text = strings.ToLower(text)
+	for _, help := range commandHelp {
+		if name := strings.Fields(help); len(name) > 0 && name[0] == text {
+			return true
+		}
+	}
+	return false
+}
+
 func (handler *CommandHandler) CommandMux(ce *CommandEvent) {
 	switch ce.Command {
 	case "relaybot":
 		handler.CommandRelaybot(ce)
 	case "login":
 		handler.CommandLogin(ce)
-	//case "logout-matrix":
-	//	handler.CommandLogoutMatrix(ce)
+	case "cancel":
+		ce.Reply("There is no ongoing command to cancel.")
+	case "logout-matrix":
+		handler.CommandLogoutMatrix(ce)
 	case "help":
 		handler.CommandHelp(ce)
 	//case "version":
@@ -105,15 +215,28 @@ func (handler *CommandHandler) CommandMux(ce *CommandEvent) {
 		handler.CommandSavePassword(ce)
 	case "remove-password":
 		handler.CommandRemovePassword(ce)
-	case "login-matrix", "sync", "list", "open", "pm", "invite", "kick", "leave", "join", "create", "share":
+	case "delete-portal":
+		handler.CommandDeletePortal(ce)
+	case "delete-all-portals":
+		handler.CommandDeleteAllPortals(ce)
+	case "unbridge":
+		handler.CommandUnbridge(ce)
+	case "unset-relay":
+		handler.CommandUnsetRelay(ce)
+	case "encrypt":
+		handler.CommandEncrypt(ce)
+	case "encrypt-all":
+		handler.CommandEncryptAll(ce)
+	case "login-matrix", "sync", "list", "open", "pm", "invite", "kick", "leave", "join", "create", "share", "rebridge", "bridge", "block", "unblock",
+		"add-contact", "remove-contact", "contact-requests", "accept", "decline", "search", "sync-direct", "set-relay":
 		if !ce.User.HasSession() {
 			ce.Reply("You're not logged in. Use the `login` command to log into Skype.")
 			return
 		}
 
 		switch ce.Command {
-		//case "login-matrix":
-		//	handler.CommandLoginMatrix(ce)
+		case "login-matrix":
+			handler.CommandLoginMatrix(ce)
 		case "sync":
 			handler.CommandSync(ce)
 		case "list":
@@ -134,6 +257,26 @@ func (handler *CommandHandler) CommandMux(ce *CommandEvent) {
 			handler.CommandShare(ce)
 		case "create":
 			handler.CommandCreate(ce)
+		case "rebridge":
+			handler.CommandRebridge(ce)
+		case "bridge":
+			handler.CommandBridge(ce)
+		case "block", "unblock":
+			handler.CommandBlock(ce)
+		case "add-contact":
+			handler.CommandAddContact(ce)
+		case "remove-contact":
+			handler.CommandRemoveContact(ce)
+		case "contact-requests":
+			handler.CommandContactRequests(ce)
+		case "accept", "decline":
+			handler.CommandAnswerContactRequest(ce)
+		case "search":
+			handler.CommandSearch(ce)
+		case "sync-direct":
+			handler.CommandSyncDirect(ce)
+		case "set-relay":
+			handler.CommandSetRelay(ce)
 		}
 	default:
 		handler.CommandSpecialMux(ce)
@@ -216,24 +359,63 @@ func (handler *CommandHandler) CommandSetPowerLevel(ce *CommandEvent) {
 	}
 }
 
-const cmdLoginHelp = `login - login <_username_> <_password_>`
+const cmdLoginHelp = `login [_username_] - Log into Skype. The bridge asks for the username and password, and redacts them right away.`
 
 // CommandLogin handles login command
 func (handler *CommandHandler) CommandLogin(ce *CommandEvent) {
-	if len(ce.Args) == 0 {
-		ce.Reply("**Usage:** `login username password`")
-		return
-	}
 	if ce.User.Conn != nil && ce.User.Conn.LoggedIn == true {
 		ce.Reply("You're already logged into Skype.")
 		return
 	}
-	leavePortals(ce)
+	switch len(ce.Args) {
+	case 0:
+		state := &CommandState{
+			RoomID: ce.RoomID,
+			Action: "Login",
+			Prompt: "Please send your Skype username, or `cancel` to cancel.",
+			Next:   handler.loginEnterUsername,
+		}
+		ce.User.SetCommandState(ce, state)
+		ce.Reply(state.Prompt)
+	case 1:
+		handler.loginEnterUsername(ce, ce.Args[0])
+	default:
+		// The old single-message form is still accepted, but the password shouldn't stay in the room
+		ce.redactCommand(nil)
+		handler.doLogin(ce, ce.Args[0], ce.Args[1])
+	}
+}
+
+const cmdCancelHelp = `cancel - Cancel an ongoing interactive command, like login.`
+
+func (handler *CommandHandler) loginEnterUsername(ce *CommandEvent, username string) {
+	ce.redactCommand(nil)
+	username = strings.TrimSpace(username)
+	if len(username) == 0 {
+		ce.Reply("Please send your Skype username, or `cancel` to cancel.")
+		return
+	}
+	state := &CommandState{
+		RoomID: ce.RoomID,
+		Action: "Login",
+		Prompt: "Please send your Skype password, or `cancel` to cancel. The message will be redacted right away.",
+		Next: func(ce *CommandEvent, password string) {
+			ce.redactCommand(nil)
+			ce.User.SetCommandState(nil, nil)
+			handler.doLogin(ce, username, password)
+		},
+	}
+	ce.User.SetCommandState(ce, state)
+	ce.Reply(state.Prompt)
+}
+
+func (handler *CommandHandler) doLogin(ce *CommandEvent, username, password string) {
+	leavePortals(ce.User)
 	if !ce.User.Connect(true) {
 		ce.User.log.Debugln("Connect() returned false, assuming error was logged elsewhere and canceling login.")
 		return
 	}
-	err := ce.User.Login(ce, ce.Args[0], ce.Args[1])
+	err := ce.User.Login(ce, username, password)
 	if err == nil {
 		syncAll(ce.User, true)
 	}
@@ -246,44 +428,9 @@ func (handler *CommandHandler) CommandLogout(ce *CommandEvent) {
 		ce.Reply("You're not logged into Skype.")
 		return
 	}
-	//_ = ce.User.Conn.GetConversations("", ce.User.bridge.Config.Bridge.InitialChatSync)
-	ce.User.Conn.LoggedIn = false
-	username := ""
-	password := ""
-	if ce.User.Conn.LoginInfo != nil {
-		username = ce.User.Conn.LoginInfo.Username
-		password = ce.User.Conn.LoginInfo.Password
-	}
-	ce.User.Conn.LoginInfo = &skype.Session{
-		SkypeToken:           "",
-		SkypeExpires:         "",
-		RegistrationToken:    "",
-		RegistrationTokenStr: "",
-		RegistrationExpires:  "",
-		LocationHost:         "",
-		EndpointId:           "",
-		Username:             username,
-		Password:             password,
-	}
-
-	ce.User.Conn.Store = &skype.Store{
-		Contacts: make(map[string]skype.Contact),
-		Chats:    make(map[string]skype.Conversation),
-	}
-	puppet := handler.bridge.GetPuppetByJID(ce.User.JID)
-	if puppet.CustomMXID != "" {
-		err := puppet.SwitchCustomMXID("", "")
-		if err != nil {
-			ce.User.log.Warnln("Failed to logout-matrix while logging out of WhatsApp:", err)
-		}
-	}
+	ce.User.Logout()
 	ce.Reply("Logged out successfully.")
-	ce.User.Conn.LoginInfo = nil
-	if ce.User.Conn.Refresh != nil {
-		ce.User.Conn.Refresh <- -1
-	} else {
-		leavePortals(ce)
-	}
+	var username, password string
 	ret := ce.User.bridge.DB.User.GetCredentialsByMXID(ce.User.MXID, &password, &username)
 	if ret && password != "" {
 		ce.Reply("WARNING, your password is stored in database. Use command `remove-password` to remove it.")
@@ -331,8 +478,8 @@ func (handler *CommandHandler) CommandRemovePassword(ce *CommandEvent) {
 	}
 }
 
-func leavePortals(ce *CommandEvent) {
-	portals := ce.User.GetPortals()
+func leavePortals(user *User) {
+	portals := user.GetPortals()
 	//newPortals := ce.User.GetPortalsNew()
 	//allPortals := newPortals[0:]
 	//for _, portal := range portals {
@@ -351,7 +498,7 @@ func leavePortals(ce *CommandEvent) {
 		if len(portal.MXID) > 0 {
 			_, _ = portal.MainIntent().KickUser(portal.MXID, &mautrix.ReqKickUser{
 				Reason: "Logout",
-				UserID: ce.User.MXID,
+				UserID: user.MXID,
 			})
 		}
 	}
@@ -398,6 +545,47 @@ func (handler *CommandHandler) CommandPing(ce *CommandEvent) {
 
 const cmdHelpHelp = `help - Prints this help`
 
+// commandHelp lists the help of each command in the order that help shows them. Each starts with the command name.
+var commandHelp = []string{
+	cmdHelpHelp,
+	cmdLoginHelp,
+	cmdCancelHelp,
+	cmdLogoutHelp,
+	cmdSavePasswordHelp,
+	cmdRemovePasswordHelp,
+	cmdPingHelp,
+	cmdLoginMatrixHelp,
+	cmdLogoutMatrixHelp,
+	cmdSyncHelp,
+	cmdSyncDirectHelp,
+	cmdListHelp,
+	cmdOpenHelp,
+	cmdSearchHelp,
+	cmdPMHelp,
+	cmdCreateHelp,
+	cmdBridgeHelp,
+	cmdInviteHelp,
+	cmdKickHelp,
+	cmdLeaveHelp,
+	cmdJoinHelp,
+	cmdShareHelp,
+	cmdAddContactHelp,
+	cmdRemoveContactHelp,
+	cmdContactRequestsHelp,
+	cmdAcceptHelp,
+	cmdDeclineHelp,
+	cmdBlockHelp,
+	cmdUnblockHelp,
+	cmdDeletePortalHelp,
+	cmdDeleteAllPortalsHelp,
+	cmdUnbridgeHelp,
+	cmdSetRelayHelp,
+	cmdUnsetRelayHelp,
+	cmdEncryptHelp,
+	cmdEncryptAllHelp,
+	cmdRebridgeHelp,
+}
+
 // CommandHelp handles help command
 func (handler *CommandHandler) CommandHelp(ce *CommandEvent) {
 	cmdPrefix := ""
@@ -405,26 +593,11 @@ func (handler *CommandHandler) CommandHelp(ce *CommandEvent) {
 		cmdPrefix = handler.bridge.Config.Bridge.CommandPrefix + " "
 	}
 
-	ce.Reply("* " + strings.Join([]string{
-		cmdPrefix + cmdHelpHelp,
-		cmdPrefix + cmdLoginHelp,
-		cmdPrefix + cmdLogoutHelp,
-		cmdPrefix + cmdSavePasswordHelp,
-		cmdPrefix + cmdRemovePasswordHelp,
-		cmdPrefix + cmdPingHelp,
-		//cmdPrefix + cmdLoginMatrixHelp,
-		//cmdPrefix + cmdLogoutMatrixHelp,
-		cmdPrefix + cmdSyncHelp,
-		cmdPrefix + cmdListHelp,
-		cmdPrefix + cmdOpenHelp,
-		cmdPrefix + cmdPMHelp,
-		cmdPrefix + cmdCreateHelp,
-		cmdPrefix + cmdInviteHelp,
-		cmdPrefix + cmdKickHelp,
-		cmdPrefix + cmdLeaveHelp,
-		cmdPrefix + cmdJoinHelp,
-		cmdPrefix + cmdShareHelp,
-	}, "\n* "))
+	lines := make([]string, len(commandHelp))
+	for i, help := range commandHelp {
+		lines[i] = cmdPrefix + help
+	}
+	ce.Reply("* " + strings.Join(lines, "\n* "))
 }
 
 const cmdSyncHelp = `sync - Synchronize contacts and optionally create portals for group chats.`
@@ -453,6 +626,17 @@ func (handler *CommandHandler) CommandSync(ce *CommandEvent) {
 	ce.Reply("Sync complete.")
 }
 
+const cmdSyncDirectHelp = `sync-direct - Rebuild the list of direct chats of your Matrix account from your private chat portals.`
+
+func (handler *CommandHandler) CommandSyncDirect(ce *CommandEvent) {
+	if ce.User.customIntent() == nil {
+		ce.Reply("The direct chat list can only be updated when double puppeting is enabled for your account.")
+		return
+	}
+	count := ce.User.SyncDirectChats()
+	ce.Reply("Updated the direct chat list with %d private chat portals.", count)
+}
+
 func syncAll(user *User, create bool) {
 	//ce.Reply("Syncing contacts...")
 	user.syncPuppets(nil, false)
@@ -482,12 +666,9 @@ func (handler *CommandHandler) CommandDeletePortal(ce *CommandEvent) {
 		return
 	}
 
-	if !ce.User.Admin {
-		users := portal.GetUserIDs()
-		if len(users) > 1 || (len(users) == 1 && users[0] != ce.User.MXID) {
-			ce.Reply("Only bridge admins can delete portals with other Matrix users")
-			return
-		}
+	if !canModifyPortal(ce.User, portal) {
+		ce.Reply("Only bridge admins can delete portals with other Matrix users")
+		return
 	}
 
 	portal.log.Infoln(ce.User.MXID, "requested deletion of portal.")
@@ -495,6 +676,181 @@ func (handler *CommandHandler) CommandDeletePortal(ce *CommandEvent) {
 	portal.Cleanup(false)
 }
 
+// canModifyPortal checks that the portal isn't used by other Matrix users, unless the user is a bridge admin.
+func canModifyPortal(user *User, portal *Portal) bool {
+	if user.Admin {
+		return true
+	}
+	users := portal.GetUserIDs()
+	return !(len(users) > 1 || (len(users) == 1 && users[0] != user.MXID))
+}
+
+const cmdSetRelayHelp = `set-relay - Relay messages of Matrix users without a Skype login in the current group through your Skype account.`
+
+func (handler *CommandHandler) CommandSetRelay(ce *CommandEvent) {
+	portal := ce.Bridge.GetPortalByMXID(ce.RoomID)
+	if portal == nil {
+		ce.Reply("You must be in a portal room to use that command")
+		return
+	} else if portal.IsPrivateChat() {
+		ce.Reply("Relay mode can only be enabled in group portals")
+		return
+	} else if !ce.User.IsInPortal(portal.Key) {
+		ce.Reply("You must be a member of the Skype group to relay messages in it")
+		return
+	}
+
+	prevRelayUser := portal.RelayUserID
+	if prevRelayUser == ce.User.MXID {
+		ce.Reply("Messages in this room are already relayed through your Skype account")
+		return
+	} else if len(prevRelayUser) > 0 && !ce.User.Admin {
+		ce.Reply("Messages in this room are already relayed through the Skype account of %s", prevRelayUser)
+		return
+	}
+	portal.log.Infoln(ce.User.MXID, "enabled relay mode, previous relay user:", prevRelayUser)
+	portal.SetRelayUser(ce.User)
+	ce.Reply("Messages from Matrix users without a Skype login will now be relayed through your Skype account")
+}
+
+const cmdUnsetRelayHelp = `unset-relay - Stop relaying messages in the current group. Limited to the relay user and bridge admins.`
+
+func (handler *CommandHandler) CommandUnsetRelay(ce *CommandEvent) {
+	portal := ce.Bridge.GetPortalByMXID(ce.RoomID)
+	if portal == nil {
+		ce.Reply("You must be in a portal room to use that command")
+		return
+	} else if len(portal.RelayUserID) == 0 {
+		ce.Reply("Relay mode is not enabled in this room")
+		return
+	} else if portal.RelayUserID != ce.User.MXID && !ce.User.Admin {
+		ce.Reply("Only %s and bridge admins can disable relay mode in this room", portal.RelayUserID)
+		return
+	}
+	portal.log.Infoln(ce.User.MXID, "disabled relay mode, previous relay user:", portal.RelayUserID)
+	portal.SetRelayUser(nil)
+	ce.Reply("Messages from Matrix users without a Skype login will no longer be relayed")
+}
+
+const cmdEncryptHelp = `encrypt - Enable end-to-bridge encryption in the current portal. Limited to room admins.`
+
+func (handler *CommandHandler) CommandEncrypt(ce *CommandEvent) {
+	if handler.bridge.Crypto == nil {
+		ce.Reply("End-to-bridge encryption is not enabled on this bridge")
+		return
+	}
+	portal := ce.Bridge.GetPortalByMXID(ce.RoomID)
+	if portal == nil {
+		ce.Reply("You must be in a portal room to use that command")
+		return
+	} else if portal.Encrypted {
+		ce.Reply("This portal is already encrypted")
+		return
+	}
+	if !ce.User.Admin {
+		levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+		if err != nil {
+			portal.log.Warnln("Failed to get power levels to check encrypt permission:", err)
+			ce.Reply("Failed to check your power level: %v", err)
+			return
+		} else if levels.GetUserLevel(ce.User.MXID) < levels.GetEventLevel(event.StateEncryption) {
+			ce.Reply("Only room admins can enable encryption in this portal")
+			return
+		}
+	}
+	portal.log.Infoln(ce.User.MXID, "requested enabling encryption")
+	err := portal.EnableEncryption()
+	if err != nil {
+		portal.log.Errorln("Failed to enable encryption:", err)
+		ce.Reply("Failed to enable encryption: %v", err)
+		return
+	}
+	ce.Reply("Enabled encryption in this portal")
+}
+
+const cmdEncryptAllHelp = `encrypt-all - Enable end-to-bridge encryption in all unencrypted portals. Limited to bridge admins.`
+
+func (handler *CommandHandler) CommandEncryptAll(ce *CommandEvent) {
+	if handler.bridge.Crypto == nil {
+		ce.Reply("End-to-bridge encryption is not enabled on this bridge")
+		return
+	} else if !ce.User.Admin {
+		ce.Reply("Only bridge admins can enable encryption in all portals")
+		return
+	}
+	var portals []*Portal
+	for _, portal := range handler.bridge.GetAllPortals() {
+		if len(portal.MXID) > 0 && !portal.Encrypted {
+			portals = append(portals, portal)
+		}
+	}
+	if len(portals) == 0 {
+		ce.Reply("All portals are already encrypted")
+		return
+	}
+	ce.Reply("Enabling encryption in %d portals...", len(portals))
+	failed := 0
+	for _, portal := range portals {
+		err := portal.EnableEncryption()
+		if err != nil {
+			portal.log.Errorln("Failed to enable encryption:", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		ce.Reply("Enabled encryption in %d portals, %d failed (see logs for details)", len(portals)-failed, failed)
+	} else {
+		ce.Reply("Enabled encryption in %d portals", len(portals))
+	}
+}
+
+const cmdUnbridgeHelp = `unbridge - Detach the current room from its Skype chat, but keep the Matrix room.`
+
+func (handler *CommandHandler) CommandUnbridge(ce *CommandEvent) {
+	portal := ce.Bridge.GetPortalByMXID(ce.RoomID)
+	if portal == nil {
+		ce.Reply("You must be in a portal room to use that command")
+		return
+	}
+
+	if !canModifyPortal(ce.User, portal) {
+		ce.Reply("Only bridge admins can unbridge portals with other Matrix users")
+		return
+	}
+
+	portal.log.Infoln(ce.User.MXID, "requested unbridging of portal.")
+	ce.Reply("Unbridging this room from Skype. The room will be kept, but messages will no longer be bridged.")
+	portal.Unbridge()
+}
+
+const cmdRebridgeHelp = `rebridge - Replace the current portal room with a fresh one for the same Skype chat.`
+
+func (handler *CommandHandler) CommandRebridge(ce *CommandEvent) {
+	portal := ce.Bridge.GetPortalByMXID(ce.RoomID)
+	if portal == nil {
+		ce.Reply("You must be in a portal room to use that command")
+		return
+	}
+
+	if ce.User.Conn == nil || !ce.User.Conn.LoggedIn {
+		ce.Reply("You're not logged into Skype.")
+		return
+	}
+
+	if !canModifyPortal(ce.User, portal) {
+		ce.Reply("Only bridge admins can rebridge portals with other Matrix users")
+		return
+	}
+
+	portal.log.Infoln(ce.User.MXID, "requested rebridging of portal.")
+	err := portal.Recreate(ce.User)
+	if err != nil {
+		ce.Reply("Failed to create new portal room: %v", err)
+		return
+	}
+	ce.Reply("Created new portal room and invited you to it.")
+}
+
 const cmdDeleteAllPortalsHelp = `delete-all-portals - Delete all your portals that aren't used by any other user.'`
 
 func (handler *CommandHandler) CommandDeleteAllPortals(ce *CommandEvent) {
@@ -718,24 +1074,75 @@ func (handler *CommandHandler) CommandOpen(ce *CommandEvent) {
 //	_, _ = portal.MainIntent().InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: user.MXID})
 //}
 
-const cmdPMHelp = `pm <_user ID_> - Open a private chat with the given user id.`
+const cmdSearchHelp = `search <_query_> - Search the Skype user directory by name, Skype ID or email.`
+
+func (handler *CommandHandler) CommandSearch(ce *CommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `search <query>`")
+		return
+	}
+	resp, err := ce.User.Conn.NameSearch(strings.Join(ce.Args, " "))
+	if err != nil {
+		ce.Reply("Failed to search the Skype directory: %v", err)
+		return
+	} else if len(resp.Results) == 0 {
+		ce.User.searchResults = nil
+		ce.Reply("No users found")
+		return
+	}
+
+	results := make([]skype.Contact, 0, len(resp.Results))
+	lines := make([]string, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		profile := result.NodeProfileData
+		contactID := "8:" + profile.SkypeId
+		contact := skype.Contact{
+			PersonId:    contactID + skypeExt.NewUserSuffix,
+			DisplayName: profile.Name,
+		}
+		contact.Profile.AvatarUrl = fmt.Sprintf("https://avatar.skype.com/v1/avatars/%s/public?returnDefaultImage=false", profile.SkypeId)
+		// The puppet is only created when pm picks the result
+		results = append(results, contact)
+		line := fmt.Sprintf("%d. %s (`%s`)", len(results), profile.Name, contactID)
+		if len(profile.CountryCode) > 0 {
+			line += " - " + strings.ToUpper(profile.CountryCode)
+		}
+		lines = append(lines, line)
+	}
+	ce.User.searchResults = results
+	ce.Reply("### Search results\n\n%s\n\nUse `pm <number>` to start a private chat with one of them.", strings.Join(lines, "\n"))
+}
+
+const cmdPMHelp = `pm <_user ID or search result number_> - Open a private chat with the given user id.`
 
 func (handler *CommandHandler) CommandPM(ce *CommandEvent) {
 	if len(ce.Args) == 0 {
 		ce.Reply("**Usage:** `pm <user id>`")
 		return
 	}
+	var contact skype.Contact
+	if index, err := strconv.Atoi(ce.Args[0]); err == nil {
+		if index < 1 || index > len(ce.User.searchResults) {
+			ce.Reply("No search result with number %d. Use `search <query>` first.", index)
+			return
+		}
+		contact = ce.User.searchResults[index-1]
+		ce.Args[0] = strings.TrimSuffix(contact.PersonId, skypeExt.NewUserSuffix)
+	}
 	jid := ce.Args[0] + skypeExt.NewUserSuffix
 
 	handler.log.Debugln("Importing", jid, "for", ce.User)
 
-	contact, ok := ce.User.Conn.Store.Contacts[jid]
-	if !ok {
-		//if !force {
-		ce.Reply("User id not found in contacts. Try syncing contacts with `sync` first. ")
-		return
-		//}
-		//contact = skype.Contact{PersonId: jid}
+	if len(contact.PersonId) == 0 {
+		var ok bool
+		contact, ok = ce.User.Conn.Store.Contacts[jid]
+		if !ok {
+			//if !force {
+			ce.Reply("User id not found in contacts. Try syncing contacts with `sync` first. ")
+			return
+			//}
+			//contact = skype.Contact{PersonId: jid}
+		}
 	}
 
 	puppet := ce.User.bridge.GetPuppetByJID(contact.PersonId)
@@ -815,7 +1222,7 @@ func (handler *CommandHandler) CommandPM(ce *CommandEvent) {
 //	ce.Reply("Created portal room and invited you to it.")
 //}
 
-const cmdLoginMatrixHelp = `login-matrix <_access token_> - Replace your WhatsApp account's Matrix puppet with your real Matrix account.'`
+const cmdLoginMatrixHelp = `login-matrix <_access token_> - Replace your Skype account's Matrix puppet with your real Matrix account.`
 
 func (handler *CommandHandler) CommandLoginMatrix(ce *CommandEvent) {
 	if len(ce.Args) == 0 {
@@ -823,20 +1230,65 @@ func (handler *CommandHandler) CommandLoginMatrix(ce *CommandEvent) {
 		return
 	}
 	puppet := handler.bridge.GetPuppetByJID(ce.User.JID)
+	prevMXID, prevAccessToken := puppet.CustomMXID, puppet.AccessToken
 	err := puppet.SwitchCustomMXID(ce.Args[0], ce.User.MXID)
 	if err != nil {
-		ce.Reply("Failed to switch puppet: %v", err)
+		ce.redactCommand(nil)
+		if errors.Is(err, ErrMismatchingMXID) {
+			ce.Reply("Failed to switch puppet: the access token belongs to a different Matrix account")
+		} else {
+			ce.Reply("Failed to switch puppet: %v", err)
+		}
+		if len(prevMXID) > 0 {
+			err = puppet.SwitchCustomMXID(prevAccessToken, prevMXID)
+			if err != nil {
+				handler.log.Warnfln("Failed to restore previous custom puppet of %s: %v", ce.User.MXID, err)
+			}
+		}
+		return
+	}
+	ce.redactCommand(puppet.CustomIntent())
+	go ce.User.SyncDirectChats()
+	ce.Reply("Successfully switched puppet. The following features are now active:\n\n%s", doublePuppetFeatures(handler.bridge))
+}
+
+// doublePuppetFeatures lists what double puppeting changes, depending on the bridge config.
+func doublePuppetFeatures(bridge *Bridge) string {
+	features := []string{
+		"Messages you send from other Skype clients are bridged as sent by your Matrix account",
+		"Favourite, hidden and muted Skype chats are synced to your room tags and notification settings",
+		"Private chat portals are added to your direct chat list",
+	}
+	if bridge.Config.Bridge.SyncWithCustomPuppets {
+		features = append(features, "Room tag and notification changes are bridged back to Skype")
+	} else {
+		features = append(features, "Room tag and notification changes are **not** bridged back to Skype, as syncing with custom puppets is disabled")
+	}
+	features = append(features, "Read receipts and typing notifications are **not** bridged yet")
+	return "* " + strings.Join(features, "\n* ")
+}
+
+// redactCommand removes the command message, e.g. when it contains an access token.
+// The message is redacted with the given intent if possible, as the bridge bot may not have permission to do so.
+func (ce *CommandEvent) redactCommand(intent *appservice.IntentAPI) {
+	if len(ce.EventID) == 0 {
 		return
 	}
-	ce.Reply("Successfully switched puppet")
+	if intent == nil {
+		intent = ce.Bot
+	}
+	_, err := intent.RedactEvent(ce.RoomID, ce.EventID)
+	if err != nil {
+		ce.Handler.log.Warnfln("Failed to redact command from %s: %v", ce.User.MXID, err)
+	}
 }
 
-const cmdLogoutMatrixHelp = `logout-matrix - Switch your WhatsApp account's Matrix puppet back to the default one.`
+const cmdLogoutMatrixHelp = `logout-matrix - Switch your Skype account's Matrix puppet back to the default one.`
 
 func (handler *CommandHandler) CommandLogoutMatrix(ce *CommandEvent) {
 	puppet := handler.bridge.GetPuppetByJID(ce.User.JID)
 	if len(puppet.CustomMXID) == 0 {
-		ce.Reply("You had not changed your WhatsApp account's Matrix puppet.")
+		ce.Reply("You had not changed your Skype account's Matrix puppet.")
 		return
 	}
 	err := puppet.SwitchCustomMXID("", "")
@@ -942,6 +1394,116 @@ func (handler *CommandHandler) CommandKick(ce *CommandEvent) {
 	}
 }
 
+const cmdAddContactHelp = `add-contact <_contact ID_> [greeting] - Send a contact request to a Skype user.`
+
+func (handler *CommandHandler) CommandAddContact(ce *CommandEvent) {
+	if len(ce.Args) < 1 {
+		ce.Reply("**Usage:** `add-contact <contact ID> [greeting]`")
+		return
+	}
+	contactID := normalizeContactID(ce.Args[0])
+	err := ce.User.Conn.SendContactRequest(contactID, strings.Join(ce.Args[1:], " "))
+	if err != nil {
+		ce.Reply("Failed to send contact request to %s: %v", contactID, err)
+		return
+	}
+	ce.Reply("Contact request sent to %s", contactID)
+}
+
+const cmdRemoveContactHelp = `remove-contact <_contact ID_> - Remove a Skype user from your contacts.`
+
+func (handler *CommandHandler) CommandRemoveContact(ce *CommandEvent) {
+	if len(ce.Args) < 1 {
+		ce.Reply("**Usage:** `remove-contact <contact ID>`")
+		return
+	}
+	contactID := normalizeContactID(ce.Args[0])
+	err := ce.User.Conn.RemoveContact(contactID)
+	if err != nil {
+		ce.Reply("Failed to remove %s from contacts: %v", contactID, err)
+		return
+	}
+	delete(ce.User.Conn.Store.Contacts, contactID+skypeExt.NewUserSuffix)
+	ce.Reply("Removed %s from contacts", contactID)
+}
+
+const cmdContactRequestsHelp = `contact-requests - List pending incoming contact requests.`
+
+func (handler *CommandHandler) CommandContactRequests(ce *CommandEvent) {
+	invites, err := ce.User.Conn.GetContactInvites()
+	if err != nil {
+		ce.Reply("Failed to get contact requests: %v", err)
+		return
+	} else if len(invites) == 0 {
+		ce.Reply("No pending contact requests")
+		return
+	}
+	lines := make([]string, 0, len(invites))
+	for _, invite := range invites {
+		lines = append(lines, formatContactInvite(invite))
+	}
+	ce.Reply("### Pending contact requests\n\n%s\n\nUse `accept <contact ID>` or `decline <contact ID>` to answer them.", strings.Join(lines, "\n"))
+}
+
+const cmdAcceptHelp = `accept <_contact ID_> - Accept a contact request.`
+const cmdDeclineHelp = `decline <_contact ID_> - Decline a contact request.`
+
+func (handler *CommandHandler) CommandAnswerContactRequest(ce *CommandEvent) {
+	if len(ce.Args) < 1 {
+		ce.Reply("**Usage:** `%s <contact ID>`", ce.Command)
+		return
+	}
+	contactID := normalizeContactID(ce.Args[0])
+	var err error
+	if ce.Command == "accept" {
+		err = ce.User.Conn.AcceptContactInvite(contactID)
+	} else {
+		err = ce.User.Conn.DeclineContactInvite(contactID)
+	}
+	if err != nil {
+		ce.Reply("Failed to %s contact request from %s: %v", ce.Command, contactID, err)
+		return
+	}
+	if ce.Command == "accept" {
+		err = ce.User.Conn.ContactList(ce.User.Conn.UserProfile.Username)
+		if err != nil {
+			handler.log.Warnln("Failed to refresh contact list after accepting contact request:", err)
+		}
+		ce.Reply("Accepted contact request from %s", contactID)
+	} else {
+		ce.Reply("Declined contact request from %s", contactID)
+	}
+}
+
+const cmdBlockHelp = `block [_contact ID_] - Block a Skype contact. Defaults to the contact of the current private chat portal.`
+const cmdUnblockHelp = `unblock [_contact ID_] - Unblock a Skype contact. Defaults to the contact of the current private chat portal.`
+
+func (handler *CommandHandler) CommandBlock(ce *CommandEvent) {
+	var contactID string
+	if len(ce.Args) > 0 {
+		contactID = ce.Args[0]
+	} else if portal := handler.bridge.GetPortalByMXID(ce.RoomID); portal != nil && portal.IsPrivateChat() {
+		contactID = portal.Key.JID
+	} else {
+		ce.Reply("**Usage:** `%s <contact ID>`", ce.Command)
+		return
+	}
+
+	var err error
+	if ce.Command == "block" {
+		err = ce.User.BlockContact(contactID)
+	} else {
+		err = ce.User.UnblockContact(contactID)
+	}
+	if err != nil {
+		ce.Reply("Failed to %s %s: %v", ce.Command, contactID, err)
+	} else if ce.Command == "block" {
+		ce.Reply("Blocked %s", normalizeContactID(contactID))
+	} else {
+		ce.Reply("Unblocked %s", normalizeContactID(contactID))
+	}
+}
+
 const cmdLeaveHelp = `leave <_group ID_> - Leave a group.`
 
 func (handler *CommandHandler) CommandLeave(ce *CommandEvent) {
@@ -1084,6 +1646,58 @@ func (handler *CommandHandler) CommandJoin(ce *CommandEvent) {
 //	}
 //}
 
+const cmdBridgeHelp = `bridge <_group ID_> [--sync-metadata] - Bridge the current room to an existing Skype group. With --sync-metadata, the room name and topic are replaced with the group's.`
+
+func (handler *CommandHandler) CommandBridge(ce *CommandEvent) {
+	if len(ce.Args) == 0 || (len(ce.Args) > 1 && ce.Args[1] != "--sync-metadata") {
+		ce.Reply("**Usage:** `bridge <group ID> [--sync-metadata]`")
+		return
+	}
+	syncMetadata := len(ce.Args) > 1
+	if ce.RoomID == ce.User.ManagementRoom {
+		ce.Reply("The management room can't be bridged")
+		return
+	} else if handler.bridge.GetPortalByMXID(ce.RoomID) != nil {
+		ce.Reply("This is already a portal room")
+		return
+	}
+	if !ce.User.Admin {
+		levels, err := ce.Bot.PowerLevels(ce.RoomID)
+		if err != nil {
+			handler.log.Warnln("Failed to get power levels to check bridge permission:", err)
+			ce.Reply("Failed to check your power level: %v", err)
+			return
+		} else if levels.GetUserLevel(ce.User.MXID) < levels.GetEventLevel(event.StatePowerLevels) {
+			ce.Reply("Only room admins can bridge this room")
+			return
+		}
+	}
+
+	jid := ce.Args[0]
+	if !strings.HasPrefix(jid, "19:") || !strings.HasSuffix(jid, skypeExt.GroupSuffix) {
+		ce.Reply("That doesn't look like a group ID. Group IDs look like `19:...@thread.skype`")
+		return
+	}
+	_ = ce.User.Conn.GetConversations("", handler.bridge.Config.Bridge.InitialChatSync)
+	if _, ok := ce.User.Conn.Store.Chats[jid]; !ok {
+		ce.Reply("Group ID not found in groups. Try syncing groups with `sync` first.")
+		return
+	}
+
+	portal := handler.bridge.GetPortalByJID(database.GroupPortalKey(jid))
+	if len(portal.MXID) > 0 {
+		ce.Reply("That group is already bridged to [%s](https://matrix.to/#/%s)", portal.MXID, portal.MXID)
+		return
+	}
+	handler.log.Debugln(ce.User.MXID, "is bridging", ce.RoomID, "to", jid)
+	err := portal.BridgeMatrixRoom(ce.User, ce.RoomID, syncMetadata)
+	if err != nil {
+		ce.Reply("Failed to bridge room: %v", err)
+		return
+	}
+	ce.Reply("Successfully bridged this room to Skype group %s", portal.Key.JID)
+}
+
 const cmdCreateHelp = `create - Create a group chat.`
 
 func (handler *CommandHandler) CommandCreate(ce *CommandEvent) {
@@ -1124,61 +1738,10 @@ func (handler *CommandHandler) CommandCreate(ce *CommandEvent) {
 		}
 	}
 
-	selfMembers := skype.Members{}
-	member2 := skype.Member{
-		Id:   strings.Replace(ce.User.JID, skypeExt.NewUserSuffix, "", 1),
-		Role: "Admin",
-	}
-
-	selfMembers.Members = append(selfMembers.Members, member2)
-	selfMembers.Properties = skype.Properties{
-		HistoryDisclosed: "true",
-		Topic:            roomNameEvent.Name,
-	}
-	ce.User.currentCreateRoomName = roomNameEvent.Name
-	handler.log.Debugln("Create Group", roomNameEvent.Name, "with", selfMembers, participants)
-	err = ce.User.Conn.HandleGroupCreate(selfMembers)
+	portal, err := ce.User.createGroupForRoom(ce.RoomID, roomNameEvent.Name, participants, encryptionEvent.Algorithm == id.AlgorithmMegolmV1)
 	if err != nil {
 		ce.Reply("Failed to create group: %v", err)
 		return
 	}
-	participantMembers := skype.Members{}
-	for _, participant := range participants {
-		memberId := strings.Replace(participant, skypeExt.NewUserSuffix, "", 1)
-		participantMembers.Members = append(participantMembers.Members, skype.Member{
-			Id:   memberId,
-			Role: "Admin",
-		})
-	}
-	conversationId, ok := <-ce.User.Conn.CreateChan
-	handler.log.Debugln("Create Group: conversationId=", conversationId)
-	if ok {
-		portal := handler.bridge.GetPortalByJID(database.GroupPortalKey(conversationId))
-		portal.roomCreateLock.Lock()
-		defer portal.roomCreateLock.Unlock()
-		if len(portal.MXID) != 0 {
-			portal.log.Warnln("Detected race condition in room creation")
-			// TODO race condition, clean up the old room
-		}
-		portal.MXID = ce.RoomID
-		portal.Name = roomNameEvent.Name
-		portal.Encrypted = encryptionEvent.Algorithm == id.AlgorithmMegolmV1
-		if !portal.Encrypted && handler.bridge.Config.Bridge.Encryption.Default {
-			_, err = portal.MainIntent().SendStateEvent(portal.MXID, event.StateEncryption, "", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
-			if err != nil {
-				portal.log.Warnln("Failed to enable e2be:", err)
-			}
-			portal.Encrypted = true
-		}
-		handler.log.Debugln("Create Group: before update protal")
-		portal.Update()
-		portal.UpdateBridgeInfo()
-		ce.User.currentCreateRoomName = ""
-		handler.log.Debugln("Create Group: after update protal")
-
-		err = ce.User.Conn.AddMember(participantMembers, conversationId)
-		ce.Reply("Successfully created Skype group %s", portal.Key.JID)
-	}
-
-	//ce.User.addPortalToCommunity(portal)
+	ce.Reply("Successfully created Skype group %s", portal.Key.JID)
 }
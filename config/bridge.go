@@ -2,6 +2,9 @@ package config
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"text/template"
@@ -17,7 +20,8 @@ import (
 type BridgeConfig struct {
 	UsernameTemplate    string `yaml:"username_template"`
 	DisplaynameTemplate string `yaml:"displayname_template"`
-	CommunityTemplate   string `yaml:"community_template"`
+
+	PersonalFilteringSpaces bool `yaml:"personal_filtering_spaces"`
 
 	ConnectionTimeout     int  `yaml:"connection_timeout"`
 	FetchMessageOnTimeout bool `yaml:"fetch_message_on_timeout"`
@@ -34,6 +38,8 @@ type BridgeConfig struct {
 		End   bool `yaml:"end"`
 	} `yaml:"call_notices"`
 
+	ThreadActivityNotices bool `yaml:"thread_activity_notices"`
+
 	InitialChatSync      int    `yaml:"initial_chat_sync_count"`
 	InitialHistoryFill   int    `yaml:"initial_history_fill_count"`
 	HistoryDisableNotifs bool   `yaml:"initial_history_disable_notifications"`
@@ -42,6 +48,14 @@ type BridgeConfig struct {
 	SyncChatMaxAge       uint64 `yaml:"sync_max_chat_age"`
 	SyncContact          bool   `yaml:"sync_contact"`
 
+	MessageRetention struct {
+		MaxAge           int `yaml:"max_age"`
+		MaxPerPortal     int `yaml:"max_per_portal"`
+		DropContentAfter int `yaml:"drop_content_after"`
+		PruneInterval    int `yaml:"prune_interval"`
+		PruneBatchSize   int `yaml:"prune_batch_size"`
+	} `yaml:"message_retention"`
+
 	SyncWithCustomPuppets bool   `yaml:"sync_with_custom_puppets"`
 
 	InviteOwnPuppetForBackfilling bool `yaml:"invite_own_puppet_for_backfilling"`
@@ -67,6 +81,11 @@ type BridgeConfig struct {
 			RequireVerification bool `yaml:"require_verification"`
 		} `yaml:"key_sharing"`
 
+		PickleKey             string `yaml:"pickle_key"`
+		PickleKeyFile         string `yaml:"pickle_key_file"`
+		PreviousPickleKey     string `yaml:"previous_pickle_key"`
+		PreviousPickleKeyFile string `yaml:"previous_pickle_key_file"`
+
 		PuppetId struct {
 			Allow                  bool `yaml:"allow"`
 			Key                    string `yaml:"key"`
@@ -80,7 +99,37 @@ type BridgeConfig struct {
 
 	usernameTemplate    *template.Template `yaml:"-"`
 	displaynameTemplate *template.Template `yaml:"-"`
-	communityTemplate   *template.Template `yaml:"-"`
+}
+
+// GetPickleKey returns the key that the crypto store pickles should be encrypted with,
+// or nil if neither pickle_key nor pickle_key_file is set.
+func (bc *BridgeConfig) GetPickleKey() ([]byte, error) {
+	return readPickleKey("pickle_key", bc.Encryption.PickleKey, bc.Encryption.PickleKeyFile)
+}
+
+// GetPreviousPickleKey returns the key the crypto store was encrypted with before a key rotation,
+// or nil if no rotation is configured.
+func (bc *BridgeConfig) GetPreviousPickleKey() ([]byte, error) {
+	return readPickleKey("previous_pickle_key", bc.Encryption.PreviousPickleKey, bc.Encryption.PreviousPickleKeyFile)
+}
+
+func readPickleKey(name, value, file string) ([]byte, error) {
+	if len(value) > 0 && len(file) > 0 {
+		return nil, fmt.Errorf("only one of %s and %s_file can be set", name, name)
+	} else if len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s_file: %w", name, err)
+		}
+		value = strings.TrimSpace(string(data))
+		if len(value) == 0 {
+			return nil, fmt.Errorf("%s_file %s is empty", name, file)
+		}
+	}
+	if len(value) == 0 {
+		return nil, nil
+	}
+	return []byte(value), nil
 }
 
 func (bc *BridgeConfig) setDefaults() {
@@ -104,6 +153,9 @@ func (bc *BridgeConfig) setDefaults() {
 	bc.SyncChatMaxAge = 259200
 	bc.SyncContact = false
 
+	bc.MessageRetention.PruneInterval = 60
+	bc.MessageRetention.PruneBatchSize = 500
+
 	bc.SyncWithCustomPuppets = true
 
 	bc.InviteOwnPuppetForBackfilling = true
@@ -128,13 +180,9 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	if len(bc.CommunityTemplate) > 0 {
-		bc.communityTemplate, err = template.New("community").Parse(bc.CommunityTemplate)
-		if err != nil {
-			return err
-		}
+	if bc.Relaybot.messageTemplates == nil {
+		return bc.Relaybot.parseMessageFormats()
 	}
-
 	return nil
 }
 
@@ -168,21 +216,6 @@ func (bc BridgeConfig) FormatUsername(userID types.SkypeID) string {
 	return buf.String()
 }
 
-type CommunityTemplateArgs struct {
-	Localpart string
-	Server    string
-}
-
-func (bc BridgeConfig) EnableCommunities() bool {
-	return bc.communityTemplate != nil
-}
-
-func (bc BridgeConfig) FormatCommunity(localpart, server string) string {
-	var buf bytes.Buffer
-	bc.communityTemplate.Execute(&buf, CommunityTemplateArgs{localpart, server})
-	return buf.String()
-}
-
 type PermissionConfig map[string]PermissionLevel
 
 type PermissionLevel int
@@ -285,6 +318,25 @@ type RelaybotConfig struct {
 	messageTemplates *template.Template           `yaml:"-"`
 }
 
+// Formats for relayed edits and replies, which aren't keyed by msgtype.
+const (
+	RelayFormatEdit  event.MessageType = "edit"
+	RelayFormatReply event.MessageType = "reply"
+)
+
+var defaultMessageFormats = map[event.MessageType]string{
+	event.MsgText:     "<b>{{ .Sender.Displayname }}</b>: {{ .Message }}",
+	event.MsgNotice:   "<b>{{ .Sender.Displayname }}</b>: {{ .Message }}",
+	event.MsgEmote:    "* <b>{{ .Sender.Displayname }}</b> {{ .Message }}",
+	event.MsgFile:     "<b>{{ .Sender.Displayname }}</b> sent a file",
+	event.MsgImage:    "<b>{{ .Sender.Displayname }}</b> sent an image",
+	event.MsgAudio:    "<b>{{ .Sender.Displayname }}</b> sent an audio file",
+	event.MsgVideo:    "<b>{{ .Sender.Displayname }}</b> sent a video",
+	event.MsgLocation: "<b>{{ .Sender.Displayname }}</b> sent a location: {{ .Content.GeoURI }}",
+	RelayFormatEdit:   "<b>{{ .Sender.Displayname }}</b>: {{ .Message }}",
+	RelayFormatReply:  "<b>{{ .Sender.Displayname }}</b>: {{ .Message }}",
+}
+
 type umRelaybotConfig RelaybotConfig
 
 func (rc *RelaybotConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -292,15 +344,30 @@ func (rc *RelaybotConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	if err != nil {
 		return err
 	}
+	return rc.parseMessageFormats()
+}
 
+// parseMessageFormats compiles the configured message formats, using the defaults for formats that aren't configured.
+func (rc *RelaybotConfig) parseMessageFormats() error {
 	rc.messageTemplates = template.New("messageTemplates")
+	for key, format := range defaultMessageFormats {
+		if configured, ok := rc.MessageFormats[key]; ok {
+			format = configured
+		}
+		_, err := rc.messageTemplates.New(string(key)).Parse(format)
+		if err != nil {
+			return err
+		}
+	}
 	for key, format := range rc.MessageFormats {
+		if _, isDefault := defaultMessageFormats[key]; isDefault {
+			continue
+		}
 		_, err := rc.messageTemplates.New(string(key)).Parse(format)
 		if err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
@@ -316,14 +383,22 @@ type formatData struct {
 }
 
 func (rc *RelaybotConfig) FormatMessage(content *event.MessageEventContent, sender id.UserID, member *event.MemberEventContent) (string, error) {
+	return rc.FormatMessageAs(content.MsgType, content, content.FormattedBody, sender, member)
+}
+
+// FormatMessageAs renders the given format, which is either a msgtype or one of the RelayFormat constants.
+func (rc *RelaybotConfig) FormatMessageAs(format event.MessageType, content *event.MessageEventContent, message string, sender id.UserID, member *event.MemberEventContent) (string, error) {
+	if rc.messageTemplates == nil {
+		return "", errors.New("relaybot message formats haven't been loaded")
+	}
 	var output strings.Builder
-	err := rc.messageTemplates.ExecuteTemplate(&output, string(content.MsgType), formatData{
+	err := rc.messageTemplates.ExecuteTemplate(&output, string(format), formatData{
 		Sender: Sender{
 			UserID:             sender,
 			MemberEventContent: member,
 		},
 		Content: content,
-		Message: content.FormattedBody,
+		Message: message,
 	})
 	return output.String(), err
 }
@@ -18,6 +18,7 @@ package config
 
 import (
 	"io/ioutil"
+	"strings"
 
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/patch"
@@ -52,6 +53,8 @@ type Config struct {
 		Provisioning struct {
 			Prefix       string `yaml:"prefix"`
 			SharedSecret string `yaml:"shared_secret"`
+			AllowOpenID  bool   `yaml:"allow_openid"`
+			OpenIDServer string `yaml:"openid_server"`
 		} `yaml:"provisioning"`
 
 		ID  string `yaml:"id"`
@@ -70,12 +73,38 @@ type Config struct {
 	Logging appservice.LogConfig `yaml:"logging"`
 }
 
+// DoublePuppetASTokenPrefix marks double_puppet_server_map entries that double puppet the users of the server
+// by acting as them with an appservice token instead of logging in, so no access tokens are stored.
+// An empty token stands for the bridge's own as_token, which only works on the bridge's homeserver.
+const DoublePuppetASTokenPrefix = "as_token:"
+
 func (config *Config) CanAutoDoublePuppet(userID id.UserID) bool {
+	if _, appserviceMode := config.GetDoublePuppetASToken(userID); appserviceMode {
+		return true
+	}
 	_, homeserver, _ := userID.Parse()
 	_, hasSecret := config.Bridge.LoginSharedSecretMap[homeserver]
 	return hasSecret
 }
 
+// GetDoublePuppetASToken returns the appservice token that the given user should be double puppeted with,
+// or false if the user's homeserver doesn't have an as_token entry in double_puppet_server_map.
+func (config *Config) GetDoublePuppetASToken(userID id.UserID) (string, bool) {
+	_, homeserver, _ := userID.Parse()
+	entry := config.Bridge.DoublePuppetServerMap[homeserver]
+	if !strings.HasPrefix(entry, DoublePuppetASTokenPrefix) {
+		return "", false
+	}
+	token := strings.TrimPrefix(entry, DoublePuppetASTokenPrefix)
+	if len(token) == 0 {
+		if homeserver != config.Homeserver.Domain {
+			return "", false
+		}
+		token = config.AppService.ASToken
+	}
+	return token, true
+}
+
 func (config *Config) setDefaults() {
 	config.AppService.Database.MaxOpenConns = 20
 	config.AppService.Database.MaxIdleConns = 2
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"runtime/debug"
 	"time"
@@ -48,6 +49,8 @@ type CryptoHelper struct {
 	baseLog maulogger.Logger
 }
 
+var NoSessionFound = crypto.NoSessionFound
+
 func init() {
 	crypto.PostgresArrayWrapper = pq.Array
 }
@@ -68,10 +71,29 @@ func NewCryptoHelper(bridge *Bridge) Crypto {
 func (helper *CryptoHelper) Init() error {
 	helper.log.Debugln("Initializing end-to-bridge encryption...")
 
+	pickleKey, err := helper.bridge.Config.Bridge.GetPickleKey()
+	if err != nil {
+		return err
+	}
+	previousPickleKey, err := helper.bridge.Config.Bridge.GetPreviousPickleKey()
+	if err != nil {
+		return err
+	}
+	if pickleKey == nil {
+		helper.log.Warnln("No pickle key configured, crypto store will be encrypted with the default key")
+		pickleKey = database.LegacyPickleKey
+	}
+	err = helper.bridge.DB.PreparePickleKey(pickleKey, previousPickleKey)
+	if errors.Is(err, database.ErrPickleKeyChanged) {
+		return fmt.Errorf("%w: set previous_pickle_key to the old key to rotate it", err)
+	} else if err != nil {
+		return err
+	}
+
 	helper.store = database.NewSQLCryptoStore(helper.bridge.DB, helper.bridge.AS.BotMXID(),
-		fmt.Sprintf("@%s:%s", helper.bridge.Config.Bridge.FormatUsername("%"), helper.bridge.AS.HomeserverDomain))
+		fmt.Sprintf("@%s:%s", helper.bridge.Config.Bridge.FormatUsername("%"), helper.bridge.AS.HomeserverDomain),
+		pickleKey)
 
-	var err error
 	helper.client, err = helper.loginBot()
 	if err != nil {
 		return err
@@ -167,6 +189,44 @@ func (helper *CryptoHelper) Decrypt(evt *event.Event) (*event.Event, error) {
 	return helper.mach.DecryptMegolmEvent(evt)
 }
 
+// WaitForSession waits until the given Megolm session is received, or the timeout passes.
+func (helper *CryptoHelper) WaitForSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, timeout time.Duration) bool {
+	// The wait is split into short intervals, as each WaitForSession call also checks the store
+	// after its timeout. That way sessions that arrive without notifying the waiter are picked up too.
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining > time.Second {
+			remaining = time.Second
+		}
+		if helper.mach.WaitForSession(roomID, senderKey, sessionID, remaining) {
+			return true
+		} else if !time.Now().Before(deadline) {
+			return false
+		}
+	}
+}
+
+// RequestSession asks the devices of the sender of an undecryptable event for the Megolm session.
+func (helper *CryptoHelper) RequestSession(roomID id.RoomID, senderKey id.SenderKey, sessionID id.SessionID, userID id.UserID, deviceID id.DeviceID) {
+	devices := []id.DeviceID{deviceID}
+	knownDevices, err := helper.store.GetDevices(userID)
+	if err != nil {
+		helper.log.Warnfln("Failed to get device list of %s to request session %s: %v", userID, sessionID, err)
+	}
+	for knownDeviceID := range knownDevices {
+		if knownDeviceID != deviceID {
+			devices = append(devices, knownDeviceID)
+		}
+	}
+	err = helper.mach.SendRoomKeyRequest(roomID, senderKey, sessionID, "", map[id.UserID][]id.DeviceID{userID: devices})
+	if err != nil {
+		helper.log.Warnfln("Failed to send key request for %s to %s: %v", sessionID, userID, err)
+	} else {
+		helper.log.Debugfln("Sent key request for %s to %d devices of %s", sessionID, len(devices), userID)
+	}
+}
+
 func (helper *CryptoHelper) Encrypt(roomID id.RoomID, evtType event.Type, content event.Content) (*event.EncryptedEventContent, error) {
 	encrypted, err := helper.mach.EncryptMegolmEvent(roomID, evtType, &content)
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,6 +14,8 @@ import (
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/kelaresg/matrix-skype/config"
 )
 
 var (
@@ -73,6 +76,10 @@ func (bridge *Bridge) newDoublePuppetClient(mxid id.UserID, accessToken string)
 		return nil, err
 	}
 	homeserverURL, found := bridge.Config.Bridge.DoublePuppetServerMap[homeserver]
+	if strings.HasPrefix(homeserverURL, config.DoublePuppetASTokenPrefix) {
+		// The entry holds a token rather than the address, so find the homeserver like for unlisted servers
+		found = false
+	}
 	if !found {
 		if homeserver == bridge.AS.HomeserverDomain {
 			homeserverURL = bridge.AS.HomeserverURL
@@ -87,10 +94,19 @@ func (bridge *Bridge) newDoublePuppetClient(mxid id.UserID, accessToken string)
 			return nil, fmt.Errorf("double puppeting from %s is not allowed", homeserver)
 		}
 	}
+	asToken, appserviceMode := bridge.Config.GetDoublePuppetASToken(mxid)
+	if appserviceMode && len(accessToken) == 0 {
+		accessToken = asToken
+	} else {
+		appserviceMode = false
+	}
 	client, err := mautrix.NewClient(homeserverURL, mxid, accessToken)
 	if err != nil {
 		return nil, err
 	}
+	if appserviceMode {
+		client.AppServiceUserID = mxid
+	}
 	client.Logger = bridge.AS.Log.Sub(mxid.String())
 	client.Client = bridge.AS.HTTPClient
 	client.DefaultHTTPRetries = bridge.AS.DefaultHTTPRetries
@@ -101,11 +117,10 @@ func (puppet *Puppet) newCustomIntent() (*appservice.IntentAPI, error) {
 	if len(puppet.CustomMXID) == 0 {
 		return nil, ErrNoCustomMXID
 	}
-	client, err := mautrix.NewClient(puppet.bridge.AS.HomeserverURL, puppet.CustomMXID, puppet.AccessToken)
+	client, err := puppet.bridge.newDoublePuppetClient(puppet.CustomMXID, puppet.AccessToken)
 	if err != nil {
 		return nil, err
 	}
-	client.Logger = puppet.bridge.AS.Log.Sub(string(puppet.CustomMXID))
 	client.Syncer = puppet
 	client.Store = puppet
 
@@ -184,6 +199,16 @@ func (puppet *Puppet) ProcessResponse(resp *mautrix.RespSync, since string) erro
 		if portal == nil {
 			continue
 		}
+		for _, evt := range events.AccountData.Events {
+			if evt.Type != event.AccountDataRoomTags {
+				continue
+			}
+			err := evt.Content.ParseRaw(evt.Type)
+			if err != nil {
+				continue
+			}
+			go puppet.handleRoomTagEvent(portal, evt)
+		}
 		for _, evt := range events.Ephemeral.Events {
 			err := evt.Content.ParseRaw(evt.Type)
 			if err != nil {
@@ -197,6 +222,12 @@ func (puppet *Puppet) ProcessResponse(resp *mautrix.RespSync, since string) erro
 			}
 		}
 	}
+	for _, evt := range resp.AccountData.Events {
+		if evt.Type != event.AccountDataPushRules {
+			continue
+		}
+		go puppet.handlePushRulesEvent(evt)
+	}
 	for _, evt := range resp.Presence.Events {
 		if evt.Sender != puppet.CustomMXID {
 			continue
@@ -268,6 +299,9 @@ func (puppet *Puppet) handleTypingEvent(portal *Portal, evt *event.Event) {
 func (puppet *Puppet) tryRelogin(cause error, action string) bool {
 	if !puppet.bridge.Config.CanAutoDoublePuppet(puppet.CustomMXID) {
 		return false
+	} else if _, appserviceMode := puppet.bridge.Config.GetDoublePuppetASToken(puppet.CustomMXID); appserviceMode {
+		// There's no access token to refresh in appservice mode
+		return false
 	}
 	puppet.log.Debugfln("Trying to relogin after '%v' while %s", cause, action)
 	accessToken, err := puppet.loginWithSharedSecret(puppet.CustomMXID)
@@ -299,11 +333,11 @@ func (puppet *Puppet) GetFilterJSON(_ id.UserID) *mautrix.Filter {
 			Senders: []id.UserID{puppet.CustomMXID},
 			Types:   []event.Type{event.EphemeralEventPresence},
 		},
-		AccountData: mautrix.FilterPart{NotTypes: everything},
+		AccountData: mautrix.FilterPart{Types: []event.Type{event.AccountDataPushRules}},
 		Room: mautrix.RoomFilter{
 			Ephemeral:    mautrix.FilterPart{Types: []event.Type{event.EphemeralEventTyping, event.EphemeralEventReceipt}},
 			IncludeLeave: false,
-			AccountData:  mautrix.FilterPart{NotTypes: everything},
+			AccountData:  mautrix.FilterPart{Types: []event.Type{event.AccountDataRoomTags}},
 			State:        mautrix.FilterPart{NotTypes: everything},
 			Timeline:     mautrix.FilterPart{NotTypes: everything},
 		},
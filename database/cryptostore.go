@@ -32,10 +32,9 @@ type SQLCryptoStore struct {
 
 var _ crypto.Store = (*SQLCryptoStore)(nil)
 
-func NewSQLCryptoStore(db *Database, userID id.UserID, ghostIDFormat string) *SQLCryptoStore {
+func NewSQLCryptoStore(db *Database, userID id.UserID, ghostIDFormat string, pickleKey []byte) *SQLCryptoStore {
 	return &SQLCryptoStore{
-		SQLCryptoStore: crypto.NewSQLCryptoStore(db.DB, db.dialect, "", "",
-			[]byte("maunium.net/go/mautrix-whatsapp"),
+		SQLCryptoStore: crypto.NewSQLCryptoStore(db.DB, db.dialect, "", "", pickleKey,
 			&cryptoLogger{db.log.Sub("CryptoStore")}),
 		UserID:        userID,
 		GhostIDFormat: ghostIDFormat,
@@ -0,0 +1,21 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestDatabase(t *testing.T, name string) *Database {
+	db, err := New("sqlite3", filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	err = db.Init()
+	if err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	return db
+}
@@ -64,6 +64,55 @@ func (mq *MessageQuery) GetLastInChat(chat PortalKey) *Message {
 	return msg
 }
 
+// DeleteOlderThan deletes up to limit messages that were sent before the given unix timestamp.
+func (mq *MessageQuery) DeleteOlderThan(timestamp uint64, limit int) (int64, error) {
+	return mq.exec("DELETE FROM message WHERE (chat_jid, chat_receiver, jid) IN ("+
+		"SELECT chat_jid, chat_receiver, jid FROM message WHERE timestamp<$1 LIMIT $2)", timestamp, limit)
+}
+
+// GetChatsOverLimit returns the chats that have more than limit messages stored.
+func (mq *MessageQuery) GetChatsOverLimit(limit int) (chats []PortalKey) {
+	rows, err := mq.db.Query("SELECT chat_jid, chat_receiver FROM message GROUP BY chat_jid, chat_receiver HAVING COUNT(*)>$1", limit)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chat PortalKey
+		err = rows.Scan(&chat.JID, &chat.Receiver)
+		if err != nil {
+			mq.log.Errorln("Database scan failed:", err)
+			continue
+		}
+		chats = append(chats, chat)
+	}
+	return
+}
+
+// DeleteExcess deletes up to limit messages in the chat, starting from the newest one that
+// isn't among the keep most recent messages.
+func (mq *MessageQuery) DeleteExcess(chat PortalKey, keep, limit int) (int64, error) {
+	return mq.exec("DELETE FROM message WHERE (chat_jid, chat_receiver, jid) IN ("+
+		"SELECT chat_jid, chat_receiver, jid FROM message WHERE chat_jid=$1 AND chat_receiver=$2 "+
+		"ORDER BY timestamp DESC LIMIT $3 OFFSET $4)", chat.JID, chat.Receiver, limit, keep)
+}
+
+// DropContentOlderThan clears the stored content of up to limit messages that were sent
+// before the given unix timestamp.
+func (mq *MessageQuery) DropContentOlderThan(timestamp uint64, limit int) (int64, error) {
+	return mq.exec("UPDATE message SET content=$1 WHERE (chat_jid, chat_receiver, jid) IN ("+
+		"SELECT chat_jid, chat_receiver, jid FROM message WHERE timestamp<$2 AND LENGTH(content)>0 LIMIT $3)",
+		[]byte{}, timestamp, limit)
+}
+
+func (mq *MessageQuery) exec(query string, args ...interface{}) (int64, error) {
+	res, err := mq.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (mq *MessageQuery) get(query string, args ...interface{}) *Message {
 	row := mq.db.QueryRow(query, args...)
 	if row == nil {
@@ -103,6 +152,10 @@ func (msg *Message) Scan(row Scannable) *Message {
 func (msg *Message) decodeBinaryContent(content []byte) {
 	//msg.Content = &skype.Resource{}
 	msg.Content = ""
+	if len(content) == 0 {
+		// The content has been dropped by message retention
+		return
+	}
 	reader := bytes.NewReader(content)
 	dec := json.NewDecoder(reader)
 	err := dec.Decode(&msg.Content)
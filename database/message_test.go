@@ -0,0 +1,138 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	retentionChatA = GroupPortalKey("19:a@thread.skype")
+	retentionChatB = GroupPortalKey("19:b@thread.skype")
+)
+
+// newRetentionTestDatabase creates a database where chat A has messages a1-a5 and chat B has b1-b2,
+// with the number being the timestamp of the message.
+func newRetentionTestDatabase(t *testing.T) *Database {
+	db := newTestDatabase(t, "message.db")
+	for chat, count := range map[PortalKey]int{retentionChatA: 5, retentionChatB: 2} {
+		portal := db.Portal.New()
+		portal.Key = chat
+		portal.Insert()
+		for ts := 1; ts <= count; ts++ {
+			msgID := fmt.Sprintf("%s%d", chat.JID[3:4], ts)
+			msg := db.Message.New()
+			msg.Chat = chat
+			msg.JID = msgID
+			msg.MXID = id.EventID("$" + msgID)
+			msg.Sender = "8:live:alice@s.skype.net"
+			msg.Timestamp = uint64(ts)
+			msg.Content = "content of " + msgID
+			msg.Insert()
+		}
+	}
+	return db
+}
+
+// describeMessages lists the messages left in the database, with a * after those that still have content.
+func describeMessages(db *Database) string {
+	var messages []string
+	for _, chat := range []PortalKey{retentionChatA, retentionChatB} {
+		for _, msg := range db.Message.GetAll(chat) {
+			if len(msg.Content) > 0 {
+				messages = append(messages, msg.JID+"*")
+			} else {
+				messages = append(messages, msg.JID)
+			}
+		}
+	}
+	sort.Strings(messages)
+	return strings.Join(messages, ",")
+}
+
+func TestMessageQuery_Retention(t *testing.T) {
+	tests := []struct {
+		name         string
+		prune        func(mq *MessageQuery) (int64, error)
+		wantAffected int64
+		wantLeft     string
+	}{
+		{"delete older than", func(mq *MessageQuery) (int64, error) {
+			return mq.DeleteOlderThan(3, 10)
+		}, 4, "a3*,a4*,a5*"},
+		{"delete older than in batches", func(mq *MessageQuery) (total int64, err error) {
+			for {
+				var count int64
+				count, err = mq.DeleteOlderThan(3, 1)
+				total += count
+				if err != nil || count == 0 {
+					return
+				} else if count > 1 {
+					return total, fmt.Errorf("deleted %d rows in a batch of 1", count)
+				}
+			}
+		}, 4, "a3*,a4*,a5*"},
+		{"delete older than nothing to delete", func(mq *MessageQuery) (int64, error) {
+			return mq.DeleteOlderThan(1, 10)
+		}, 0, "a1*,a2*,a3*,a4*,a5*,b1*,b2*"},
+		{"delete excess", func(mq *MessageQuery) (int64, error) {
+			return mq.DeleteExcess(retentionChatA, 2, 10)
+		}, 3, "a4*,a5*,b1*,b2*"},
+		{"delete excess in batches starts after the kept messages", func(mq *MessageQuery) (int64, error) {
+			return mq.DeleteExcess(retentionChatA, 2, 1)
+		}, 1, "a1*,a2*,a4*,a5*,b1*,b2*"},
+		{"delete excess under limit", func(mq *MessageQuery) (int64, error) {
+			return mq.DeleteExcess(retentionChatB, 2, 10)
+		}, 0, "a1*,a2*,a3*,a4*,a5*,b1*,b2*"},
+		{"drop content", func(mq *MessageQuery) (int64, error) {
+			return mq.DropContentOlderThan(3, 10)
+		}, 4, "a1,a2,a3*,a4*,a5*,b1,b2"},
+		{"drop content skips dropped messages", func(mq *MessageQuery) (int64, error) {
+			_, err := mq.DropContentOlderThan(2, 10)
+			if err != nil {
+				return 0, err
+			}
+			return mq.DropContentOlderThan(3, 10)
+		}, 2, "a1,a2,a3*,a4*,a5*,b1,b2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newRetentionTestDatabase(t)
+			affected, err := tt.prune(db.Message)
+			if err != nil {
+				t.Fatalf("prune error = %v", err)
+			} else if affected != tt.wantAffected {
+				t.Errorf("prune affected %d rows, want %d", affected, tt.wantAffected)
+			}
+			if left := describeMessages(db); left != tt.wantLeft {
+				t.Errorf("messages left = %s, want %s", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestMessageQuery_GetChatsOverLimit(t *testing.T) {
+	db := newRetentionTestDatabase(t)
+	tests := []struct {
+		limit int
+		want  []PortalKey
+	}{
+		{1, []PortalKey{retentionChatA, retentionChatB}},
+		{2, []PortalKey{retentionChatA}},
+		{5, nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("limit %d", tt.limit), func(t *testing.T) {
+			chats := db.Message.GetChatsOverLimit(tt.limit)
+			sort.Slice(chats, func(i, j int) bool {
+				return chats[i].JID < chats[j].JID
+			})
+			if fmt.Sprint(chats) != fmt.Sprint(tt.want) {
+				t.Errorf("GetChatsOverLimit() = %v, want %v", chats, tt.want)
+			}
+		})
+	}
+}
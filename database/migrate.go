@@ -2,12 +2,15 @@ package database
 
 import (
 	"fmt"
-	"math"
 	"strings"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"github.com/kelaresg/matrix-skype/database/upgrades"
 )
 
 func countRows(db *Database, table string) (int, error) {
-	countRow := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+	countRow := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM \"%s\"", table))
 	var count int
 	err := countRow.Scan(&count)
 	return count, err
@@ -15,43 +18,164 @@ func countRows(db *Database, table string) (int, error) {
 
 const VariableCountLimit = 512
 
-func migrateTable(old *Database, new *Database, table string, columns ...string) error {
+// migrationColumn is a column along with the schema version that introduced it.
+// If dialect is set, the column only exists in databases of that type.
+type migrationColumn struct {
+	name    string
+	since   int
+	dialect string
+}
+
+type migrationTable struct {
+	name    string
+	since   int
+	columns []migrationColumn
+}
+
+func cols(since int, names ...string) []migrationColumn {
+	columns := make([]migrationColumn, len(names))
+	for i, name := range names {
+		columns[i] = migrationColumn{name, since, ""}
+	}
+	return columns
+}
+
+func postgresCols(since int, names ...string) []migrationColumn {
+	columns := cols(since, names...)
+	for i := range columns {
+		columns[i].dialect = "postgres"
+	}
+	return columns
+}
+
+func join(columns ...[]migrationColumn) (joined []migrationColumn) {
+	for _, part := range columns {
+		joined = append(joined, part...)
+	}
+	return
+}
+
+// migrationTables lists every table in the schema in an order that satisfies the foreign keys.
+// The versions are the schema versions (the number of applied upgrades) where a table or column first exists.
+var migrationTables = []migrationTable{
+	{"portal", 1, join(
+		cols(1, "jid", "receiver", "mxid", "name", "topic", "avatar"),
+		cols(8, "avatar_url"),
+		cols(13, "encrypted"),
+		cols(23, "description"),
+		cols(25, "relay_user_id"),
+	)},
+	{"user", 1, join(
+		cols(1, "mxid", "jid", "management_room", "endpoint_id", "skype_token", "registration_token", "registration_token_str", "location_host"),
+		cols(4, "last_connection"),
+		postgresCols(21, "password", "username"),
+		cols(22, "space_room"),
+	)},
+	{"puppet", 1, join(
+		cols(1, "jid", "avatar", "displayname", "name_quality"),
+		cols(6, "custom_mxid", "access_token", "next_batch"),
+		cols(8, "avatar_url"),
+	)},
+	{"user_portal", 7, join(
+		cols(7, "user_jid", "portal_jid", "portal_receiver"),
+		cols(22, "in_space"),
+	)},
+	{"message", 1, join(
+		cols(1, "chat_jid", "chat_receiver", "jid", "mxid", "sender", "content"),
+		cols(3, "timestamp"),
+		cols(18, "id"),
+	)},
+	{"mx_registrations", 10, cols(10, "user_id")},
+	{"mx_user_profile", 10, join(
+		cols(10, "room_id", "user_id", "membership"),
+		cols(11, "displayname", "avatar_url"),
+	)},
+	{"mx_room_state", 10, cols(10, "room_id", "power_levels")},
+	{"crypto_account", 14, join(
+		cols(16, "account_id"),
+		cols(14, "device_id", "shared", "sync_token", "account"),
+	)},
+	{"crypto_message_index", 14, cols(14, "sender_key", "session_id", `"index"`, "event_id", "timestamp")},
+	{"crypto_tracked_user", 14, cols(14, "user_id")},
+	{"crypto_device", 14, cols(14, "user_id", "device_id", "identity_key", "signing_key", "trust", "deleted", "name")},
+	{"crypto_olm_session", 14, join(
+		cols(16, "account_id"),
+		cols(14, "session_id", "sender_key", "session", "created_at", "last_used"),
+	)},
+	{"crypto_megolm_inbound_session", 14, join(
+		cols(16, "account_id"),
+		cols(14, "session_id", "sender_key", "signing_key", "room_id", "session", "forwarding_chains"),
+		cols(17, "withheld_code", "withheld_reason"),
+	)},
+	{"crypto_megolm_outbound_session", 15, join(
+		cols(16, "account_id"),
+		cols(15, "room_id", "session_id", "session", "shared", "max_messages", "message_count", "max_age", "created_at", "last_used"),
+	)},
+	{"crypto_cross_signing_keys", 19, cols(19, "user_id", "usage", "key")},
+	{"crypto_cross_signing_signatures", 19, cols(19, "signed_user_id", "signed_key", "signer_user_id", "signer_key", "signature")},
+	{"crypto_pickle_key", 26, cols(26, "key_check")},
+	{"user_contact_request", 24, cols(24, "user_mxid", "mri", "invite_time")},
+}
+
+// columnNames returns the columns of the table that exist in both databases,
+// as well as the columns that only exist in the old one.
+func (table migrationTable) columnNames(version int, oldDialect, newDialect string) (names, dropped []string) {
+	names = make([]string, 0, len(table.columns))
+	for _, col := range table.columns {
+		if col.since > version || (len(col.dialect) > 0 && col.dialect != oldDialect) {
+			continue
+		} else if len(col.dialect) > 0 && col.dialect != newDialect {
+			dropped = append(dropped, col.name)
+		} else {
+			names = append(names, col.name)
+		}
+	}
+	return
+}
+
+func migrateTable(log log.Logger, old *Database, new *Database, table string, columns ...string) error {
 	columnNames := strings.Join(columns, ",")
-	fmt.Printf("Migrating %s: ", table)
 	rowCount, err := countRows(old, table)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to count rows in old %s: %w", table, err)
 	}
-	fmt.Print("found ", rowCount, " rows of data, ")
-	rows, err := old.Query(fmt.Sprintf("SELECT %s FROM \"%s\"", columnNames, table))
+	existingCount, err := countRows(new, table)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to count rows in new %s: %w", table, err)
+	}
+	if existingCount > 0 {
+		if existingCount == rowCount {
+			log.Infofln("Skipping %s: all %d rows have already been migrated", table, rowCount)
+			return nil
+		}
+		return fmt.Errorf("new %s already contains %d rows (old has %d), empty it before migrating again", table, existingCount, rowCount)
+	} else if rowCount == 0 {
+		log.Infofln("Skipping %s: no rows to migrate", table)
+		return nil
 	}
-	serverColNames, err := rows.Columns()
+
+	rows, err := old.Query(fmt.Sprintf("SELECT %s FROM \"%s\"", columnNames, table))
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to query old %s: %w", table, err)
 	}
-	colCount := len(serverColNames)
+	defer rows.Close()
+	colCount := len(columns)
 	valueStringFormat := strings.Repeat("$%d, ", colCount)
 	valueStringFormat = fmt.Sprintf("(%s)", valueStringFormat[:len(valueStringFormat)-2])
-	cols := make([]interface{}, colCount)
-	colPtrs := make([]interface{}, colCount)
-	for i := 0; i < colCount; i++ {
-		colPtrs[i] = &cols[i]
-	}
 	batchSize := VariableCountLimit / colCount
 	values := make([]interface{}, batchSize*colCount)
 	valueStrings := make([]string, batchSize)
-	var inserted int64
-	batchCount := int(math.Ceil(float64(rowCount) / float64(batchSize)))
+	batchCount := (rowCount + batchSize - 1) / batchSize
+	log.Infofln("Migrating %d rows of %s in %d batches", rowCount, table, batchCount)
+
 	tx, err := new.Begin()
 	if err != nil {
 		return err
 	}
-	fmt.Printf("migrating in %d batches: ", batchCount)
-	for rowCount > 0 {
+	var inserted int64
+	for batch := 1; ; batch++ {
 		var i int
-		for ; rows.Next() && i < batchSize; i++ {
+		for ; i < batchSize && rows.Next(); i++ {
 			colPtrs := make([]interface{}, colCount)
 			valueStringArgs := make([]interface{}, colCount)
 			for j := 0; j < colCount; j++ {
@@ -62,91 +186,73 @@ func migrateTable(old *Database, new *Database, table string, columns ...string)
 			valueStrings[i] = fmt.Sprintf(valueStringFormat, valueStringArgs...)
 			err = rows.Scan(colPtrs...)
 			if err != nil {
-				panic(err)
+				_ = tx.Rollback()
+				return fmt.Errorf("failed to scan row from old %s: %w", table, err)
 			}
 		}
-		slicedValues := values
-		slicedValueStrings := valueStrings
-		if i < len(valueStrings) {
-			slicedValueStrings = slicedValueStrings[:i]
-			slicedValues = slicedValues[:i*colCount]
+		if err = rows.Err(); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to read rows from old %s: %w", table, err)
+		} else if i == 0 {
+			break
 		}
-		res, err := tx.Exec(fmt.Sprintf("INSERT INTO \"%s\" (%s) VALUES %s", table, columnNames, strings.Join(slicedValueStrings, ",")), slicedValues...)
+		res, err := tx.Exec(fmt.Sprintf("INSERT INTO \"%s\" (%s) VALUES %s", table, columnNames, strings.Join(valueStrings[:i], ",")), values[:i*colCount]...)
 		if err != nil {
-			panic(err)
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to insert batch %d into new %s: %w", batch, table, err)
 		}
 		count, _ := res.RowsAffected()
 		inserted += count
-		rowCount -= batchSize
-		fmt.Print("#")
+		log.Debugfln("Migrated batch %d/%d of %s (%d rows so far)", batch, batchCount, table, inserted)
+		if i < batchSize {
+			break
+		}
 	}
 	err = tx.Commit()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to commit %s: %w", table, err)
 	}
-	fmt.Println(" -- done with", inserted, "rows inserted")
-	return nil
-}
 
-func Migrate(old *Database, new *Database) {
-	err := migrateTable(old, new, "portal", "jid", "receiver", "mxid", "name", "topic", "avatar", "avatar_url", "encrypted")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "user", "mxid", "jid", "management_room", "endpoint_id", "skype_token", "registration_token", "registration_token_str", "location_host", "last_connection")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "puppet", "jid", "avatar", "displayname", "name_quality", "custom_mxid", "access_token", "next_batch", "avatar_url")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "user_portal", "user_jid", "portal_jid", "portal_receiver", "in_community")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "message", "chat_jid", "chat_receiver", "jid", "mxid", "sender", "content", "timestamp")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "mx_registrations", "user_id")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "mx_user_profile", "room_id", "user_id", "membership")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "mx_room_state", "room_id", "power_levels")
+	newCount, err := countRows(new, table)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to count rows in new %s: %w", table, err)
+	} else if newCount != rowCount {
+		return fmt.Errorf("row count mismatch in %s after migration: old has %d rows, new has %d", table, rowCount, newCount)
 	}
-	err = migrateTable(old, new, "crypto_account", "device_id", "shared", "sync_token", "account")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "crypto_message_index", "sender_key", "session_id", `"index"`, "event_id", "timestamp")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "crypto_tracked_user", "user_id")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "crypto_device", "user_id", "device_id", "identity_key", "signing_key", "trust", "deleted", "name")
-	if err != nil {
-		panic(err)
-	}
-	err = migrateTable(old, new, "crypto_olm_session", "session_id", "sender_key", "session", "created_at", "last_used")
+	log.Infofln("Migrated %s: %d rows inserted", table, inserted)
+	return nil
+}
+
+// Migrate copies every table from the old database into the new one.
+//
+// Each table is copied in its own transaction, so if the migration fails halfway,
+// running it again skips the tables that were already copied completely.
+func Migrate(old *Database, new *Database) error {
+	migrateLog := new.log.Sub("Migrate")
+	oldVersion, err := upgrades.GetVersion(old.DB)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to get old database version: %w", err)
 	}
-	err = migrateTable(old, new, "crypto_megolm_inbound_session", "session_id", "sender_key", "signing_key", "room_id", "session", "forwarding_chains")
+	newVersion, err := upgrades.GetVersion(new.DB)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to get new database version: %w", err)
+	} else if oldVersion != newVersion {
+		return fmt.Errorf("old database is on v%d, but new database is on v%d", oldVersion, newVersion)
 	}
-	err = migrateTable(old, new, "crypto_megolm_outbound_session", "room_id", "session_id", "session", "shared", "max_messages", "message_count", "max_age", "created_at", "last_used")
-	if err != nil {
-		panic(err)
+	migrateLog.Infofln("Migrating %d tables from schema v%d", len(migrationTables), oldVersion)
+	for _, table := range migrationTables {
+		if table.since > oldVersion {
+			continue
+		}
+		columns, dropped := table.columnNames(oldVersion, old.dialect, new.dialect)
+		if len(dropped) > 0 {
+			migrateLog.Warnfln("Not migrating %s columns %s: they don't exist in %s databases", table.name, strings.Join(dropped, ", "), new.dialect)
+		}
+		err = migrateTable(migrateLog, old, new, table.name, columns...)
+		if err != nil {
+			return err
+		}
 	}
+	migrateLog.Infoln("Database migration complete")
+	return nil
 }
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func fillMigrationSource(t *testing.T, db *Database) {
+	for _, jid := range []string{"19:a@thread.skype", "19:b@thread.skype"} {
+		portal := db.Portal.New()
+		portal.Key = GroupPortalKey(jid)
+		portal.MXID = id.RoomID("!" + jid[3:4] + ":example.com")
+		portal.Name = jid
+		portal.Insert()
+	}
+	for i, msgID := range []string{"1", "2", "3"} {
+		msg := db.Message.New()
+		msg.Chat = GroupPortalKey("19:a@thread.skype")
+		msg.JID = msgID
+		msg.ID = msgID
+		msg.MXID = id.EventID("$" + msgID)
+		msg.Sender = "8:live:alice@s.skype.net"
+		msg.Timestamp = uint64(i)
+		msg.Content = "message " + msgID
+		msg.Insert()
+	}
+	user := db.User.New()
+	user.MXID = "@alice:example.com"
+	user.JID = "8:live:alice@s.skype.net"
+	user.ManagementRoom = "!management:example.com"
+	user.Insert()
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare simulates what an earlier, interrupted migration left behind in the new database
+		prepare func(t *testing.T, new *Database)
+		wantErr string
+	}{
+		{"empty target", nil, ""},
+		{"resume after some tables were copied", func(t *testing.T, new *Database) {
+			fillMigrationSource(t, new)
+			_, err := new.Exec("DELETE FROM message")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+		{"partially filled table", func(t *testing.T, new *Database) {
+			portal := new.Portal.New()
+			portal.Key = GroupPortalKey("19:a@thread.skype")
+			portal.Insert()
+		}, "new portal already contains 1 rows"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := newTestDatabase(t, "old.db")
+			fillMigrationSource(t, old)
+			new := newTestDatabase(t, "new.db")
+			if tt.prepare != nil {
+				tt.prepare(t, new)
+			}
+			err := Migrate(old, new)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Migrate() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+			for table, want := range map[string]int{"portal": 2, "message": 3, "user": 1} {
+				count, err := countRows(new, table)
+				if err != nil {
+					t.Fatal(err)
+				} else if count != want {
+					t.Errorf("new %s has %d rows, want %d", table, count, want)
+				}
+			}
+			msg := new.Message.GetByJID(GroupPortalKey("19:a@thread.skype"), "2")
+			if msg == nil || msg.Content != "message 2" || msg.MXID != "$2" {
+				t.Errorf("migrated message = %+v", msg)
+			}
+		})
+	}
+}
+
+func TestMigrate_DropsPostgresOnlyColumns(t *testing.T) {
+	old := newTestDatabase(t, "old.db")
+	// Make the old database look like a Postgres one, which has the password and username columns
+	old.dialect = "postgres"
+	for _, column := range []string{"password", "username"} {
+		_, err := old.Exec(`ALTER TABLE "user" ADD COLUMN ` + column + ` VARCHAR(255)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fillMigrationSource(t, old)
+	_, err := old.Exec(`UPDATE "user" SET password='hunter2', username='alice'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new := newTestDatabase(t, "new.db")
+
+	err = Migrate(old, new)
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	user := new.User.GetByMXID("@alice:example.com")
+	if user == nil || user.ManagementRoom != "!management:example.com" {
+		t.Errorf("migrated user = %+v", user)
+	}
+}
+
+func TestMigrationTable_ColumnNames(t *testing.T) {
+	table := migrationTable{"user", 1, join(
+		cols(1, "mxid", "jid"),
+		cols(4, "last_connection"),
+		postgresCols(21, "password"),
+	)}
+	tests := []struct {
+		name        string
+		version     int
+		oldDialect  string
+		newDialect  string
+		wantNames   string
+		wantDropped string
+	}{
+		{"old schema", 3, "sqlite3", "postgres", "mxid,jid", ""},
+		{"sqlite to postgres", 25, "sqlite3", "postgres", "mxid,jid,last_connection", ""},
+		{"postgres to postgres", 25, "postgres", "postgres", "mxid,jid,last_connection,password", ""},
+		{"postgres to sqlite", 25, "postgres", "sqlite3", "mxid,jid,last_connection", "password"},
+		{"postgres to sqlite before column existed", 20, "postgres", "sqlite3", "mxid,jid,last_connection", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, dropped := table.columnNames(tt.version, tt.oldDialect, tt.newDialect)
+			if got := strings.Join(names, ","); got != tt.wantNames {
+				t.Errorf("columnNames() names = %s, want %s", got, tt.wantNames)
+			}
+			if got := strings.Join(dropped, ","); got != tt.wantDropped {
+				t.Errorf("columnNames() dropped = %s, want %s", got, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// +build cgo,!nocrypto
+
+package database
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/crypto/olm"
+)
+
+// LegacyPickleKey is the key that was used for all crypto store pickles before the key became configurable.
+var LegacyPickleKey = []byte("maunium.net/go/mautrix-whatsapp")
+
+var ErrPickleKeyChanged = errors.New("crypto store pickle key changed without a rotation step")
+
+type repickleFunc func(pickled, oldKey, newKey []byte) ([]byte, error)
+
+var pickledColumns = []struct {
+	table    string
+	column   string
+	repickle repickleFunc
+}{
+	{"crypto_account", "account", func(pickled, oldKey, newKey []byte) ([]byte, error) {
+		acc, err := olm.AccountFromPickled(pickled, oldKey)
+		if err != nil {
+			return nil, err
+		}
+		return acc.Pickle(newKey), nil
+	}},
+	{"crypto_olm_session", "session", func(pickled, oldKey, newKey []byte) ([]byte, error) {
+		sess, err := olm.SessionFromPickled(pickled, oldKey)
+		if err != nil {
+			return nil, err
+		}
+		return sess.Pickle(newKey), nil
+	}},
+	{"crypto_megolm_inbound_session", "session", func(pickled, oldKey, newKey []byte) ([]byte, error) {
+		sess, err := olm.InboundGroupSessionFromPickled(pickled, oldKey)
+		if err != nil {
+			return nil, err
+		}
+		return sess.Pickle(newKey), nil
+	}},
+	{"crypto_megolm_outbound_session", "session", func(pickled, oldKey, newKey []byte) ([]byte, error) {
+		sess, err := olm.OutboundGroupSessionFromPickled(pickled, oldKey)
+		if err != nil {
+			return nil, err
+		}
+		return sess.Pickle(newKey), nil
+	}},
+}
+
+func pickleKeyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("matrix-skype crypto store pickle key"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PreparePickleKey makes sure everything in the crypto store is pickled with the given key.
+//
+// If the store has never been tied to a key, existing data is re-pickled from the legacy key.
+// If the key has changed, previousKey must be the key the store is currently pickled with,
+// otherwise ErrPickleKeyChanged is returned and nothing is modified.
+func (db *Database) PreparePickleKey(key, previousKey []byte) error {
+	newCheck := pickleKeyCheck(key)
+	var storedCheck string
+	err := db.QueryRow("SELECT key_check FROM crypto_pickle_key").Scan(&storedCheck)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read pickle key check: %w", err)
+	} else if storedCheck == newCheck {
+		return nil
+	}
+
+	var oldKey []byte
+	if len(storedCheck) == 0 {
+		oldKey = LegacyPickleKey
+	} else if previousKey != nil && hmac.Equal([]byte(storedCheck), []byte(pickleKeyCheck(previousKey))) {
+		oldKey = previousKey
+	} else {
+		return ErrPickleKeyChanged
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(oldKey, key) {
+		for _, col := range pickledColumns {
+			var count int
+			count, err = repickleColumn(tx, col.table, col.column, col.repickle, oldKey, key)
+			if err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("failed to re-pickle %s: %w", col.table, err)
+			} else if count > 0 {
+				db.log.Infofln("Re-pickled %d rows in %s with new pickle key", count, col.table)
+			}
+		}
+	}
+	_, err = tx.Exec("DELETE FROM crypto_pickle_key")
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO crypto_pickle_key (key_check) VALUES ($1)", newCheck)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to store pickle key check: %w", err)
+	}
+	return tx.Commit()
+}
+
+func repickleColumn(tx *sql.Tx, table, column string, repickle repickleFunc, oldKey, newKey []byte) (int, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s FROM %s", column, table))
+	if err != nil {
+		return 0, err
+	}
+	var pickles [][]byte
+	for rows.Next() {
+		var pickled []byte
+		err = rows.Scan(&pickled)
+		if err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		pickles = append(pickles, pickled)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, pickled := range pickles {
+		// Unpickling decrypts the buffer in place, so work on a copy to keep the original for the WHERE clause.
+		buf := make([]byte, len(pickled))
+		copy(buf, pickled)
+		var repickled []byte
+		repickled, err = repickle(buf, oldKey, newKey)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s=$1 WHERE %s=$2", table, column, column), repickled, pickled)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(pickles), nil
+}
@@ -0,0 +1,81 @@
+// +build cgo,!nocrypto
+
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fakePickle stands in for olm pickles, which can only be unpickled with the key they were pickled with.
+func fakePickle(key []byte, data string) []byte {
+	return []byte(fmt.Sprintf("%x|%s", key, data))
+}
+
+func fakeRepickle(pickled, oldKey, newKey []byte) ([]byte, error) {
+	prefix := []byte(fmt.Sprintf("%x|", oldKey))
+	if !bytes.HasPrefix(pickled, prefix) {
+		return nil, errors.New("wrong pickle key")
+	}
+	return fakePickle(newKey, string(pickled[len(prefix):])), nil
+}
+
+func TestDatabase_PreparePickleKey(t *testing.T) {
+	origColumns := pickledColumns
+	defer func() {
+		pickledColumns = origColumns
+	}()
+	pickledColumns = pickledColumns[:0:0]
+	for _, col := range origColumns {
+		col.repickle = fakeRepickle
+		pickledColumns = append(pickledColumns, col)
+	}
+
+	keyA := []byte("key a")
+	keyB := []byte("key b")
+	keyC := []byte("key c")
+	type step struct {
+		key         []byte
+		previousKey []byte
+		wantErr     error
+	}
+	tests := []struct {
+		name          string
+		steps         []step
+		wantPickledBy []byte
+	}{
+		{"legacy store gets new key", []step{{keyA, nil, nil}}, keyA},
+		{"legacy key kept", []step{{LegacyPickleKey, nil, nil}}, LegacyPickleKey},
+		{"same key again", []step{{keyA, nil, nil}, {keyA, nil, nil}}, keyA},
+		{"rotation with previous key", []step{{keyA, nil, nil}, {keyB, keyA, nil}}, keyB},
+		{"rotation step left in config", []step{{keyA, nil, nil}, {keyB, keyA, nil}, {keyB, keyA, nil}}, keyB},
+		{"changed key refused", []step{{keyA, nil, nil}, {keyB, nil, ErrPickleKeyChanged}}, keyA},
+		{"wrong previous key refused", []step{{keyA, nil, nil}, {keyB, keyC, ErrPickleKeyChanged}}, keyA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase(t, "picklekey.db")
+			_, err := db.Exec("INSERT INTO crypto_account (account_id, device_id, shared, sync_token, account) VALUES ($1, $2, $3, $4, $5)",
+				"@bot:example.com", "DEVICE", true, "", fakePickle(LegacyPickleKey, "account"))
+			if err != nil {
+				t.Fatalf("failed to insert account: %v", err)
+			}
+			for i, step := range tt.steps {
+				err = db.PreparePickleKey(step.key, step.previousKey)
+				if !errors.Is(err, step.wantErr) {
+					t.Fatalf("step %d: PreparePickleKey() error = %v, want %v", i+1, err, step.wantErr)
+				}
+			}
+			var account []byte
+			err = db.QueryRow("SELECT account FROM crypto_account").Scan(&account)
+			if err != nil {
+				t.Fatalf("failed to read account: %v", err)
+			}
+			if want := fakePickle(tt.wantPickledBy, "account"); !bytes.Equal(account, want) {
+				t.Errorf("account = %s, want %s", account, want)
+			}
+		})
+	}
+}
@@ -97,16 +97,18 @@ type Portal struct {
 	Key  PortalKey
 	MXID id.RoomID
 
-	Name      string
-	Topic     string
-	Avatar    string
-	AvatarURL id.ContentURI
-	Encrypted bool
+	Name        string
+	Topic       string
+	Description string
+	Avatar      string
+	AvatarURL   id.ContentURI
+	Encrypted   bool
+	RelayUserID id.UserID
 }
 
 func (portal *Portal) Scan(row Scannable) *Portal {
-	var mxid, avatarURL sql.NullString
-	err := row.Scan(&portal.Key.JID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.Topic, &portal.Avatar, &avatarURL, &portal.Encrypted)
+	var mxid, avatarURL, relayUserID sql.NullString
+	err := row.Scan(&portal.Key.JID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.Topic, &portal.Avatar, &avatarURL, &portal.Encrypted, &portal.Description, &relayUserID)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			portal.log.Errorln("Database scan failed:", err)
@@ -115,6 +117,7 @@ func (portal *Portal) Scan(row Scannable) *Portal {
 	}
 	portal.MXID = id.RoomID(mxid.String)
 	portal.AvatarURL, _ = id.ParseContentURI(avatarURL.String)
+	portal.RelayUserID = id.UserID(relayUserID.String)
 	return portal
 }
 
@@ -125,9 +128,16 @@ func (portal *Portal) mxidPtr() *id.RoomID {
 	return nil
 }
 
+func (portal *Portal) relayUserPtr() *id.UserID {
+	if len(portal.RelayUserID) > 0 {
+		return &portal.RelayUserID
+	}
+	return nil
+}
+
 func (portal *Portal) Insert() {
-	_, err := portal.db.Exec("INSERT INTO portal (jid, receiver, mxid, name, topic, avatar, avatar_url, encrypted) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-		portal.Key.JID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.Topic, portal.Avatar, portal.AvatarURL.String(), portal.Encrypted)
+	_, err := portal.db.Exec("INSERT INTO portal (jid, receiver, mxid, name, topic, avatar, avatar_url, encrypted, description, relay_user_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		portal.Key.JID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.Topic, portal.Avatar, portal.AvatarURL.String(), portal.Encrypted, portal.Description, portal.relayUserPtr())
 	if err != nil {
 		portal.log.Warnfln("Failed to insert %s: %v", portal.Key, err)
 	}
@@ -138,8 +148,8 @@ func (portal *Portal) Update() {
 	if len(portal.MXID) > 0 {
 		mxid = &portal.MXID
 	}
-	_, err := portal.db.Exec("UPDATE portal SET mxid=$1, name=$2, topic=$3, avatar=$4, avatar_url=$5, encrypted=$6 WHERE jid=$7 AND receiver=$8",
-		mxid, portal.Name, portal.Topic, portal.Avatar, portal.AvatarURL.String(), portal.Encrypted, portal.Key.JID, portal.Key.Receiver)
+	_, err := portal.db.Exec("UPDATE portal SET mxid=$1, name=$2, topic=$3, avatar=$4, avatar_url=$5, encrypted=$6, description=$7, relay_user_id=$8 WHERE jid=$9 AND receiver=$10",
+		mxid, portal.Name, portal.Topic, portal.Avatar, portal.AvatarURL.String(), portal.Encrypted, portal.Description, portal.relayUserPtr(), portal.Key.JID, portal.Key.Receiver)
 	if err != nil {
 		portal.log.Warnfln("Failed to update %s: %v", portal.Key, err)
 	}
@@ -21,6 +21,15 @@ type SQLStateStore struct {
 
 	Typing     map[id.RoomID]map[id.UserID]int64
 	typingLock sync.RWMutex
+
+	replacedPowerLevels     map[id.RoomID]replacedPowerLevels
+	replacedPowerLevelsLock sync.Mutex
+}
+
+// replacedPowerLevels are the power levels of a room that SetPowerLevels overwrote, along with the new levels.
+type replacedPowerLevels struct {
+	prev *event.PowerLevelsEventContent
+	new  *event.PowerLevelsEventContent
 }
 
 var _ appservice.StateStore = (*SQLStateStore)(nil)
@@ -30,6 +39,8 @@ func NewSQLStateStore(db *Database) *SQLStateStore {
 		TypingStateStore: appservice.NewTypingStateStore(),
 		db:               db,
 		log:              db.log.Sub("StateStore"),
+
+		replacedPowerLevels: make(map[id.RoomID]replacedPowerLevels),
 	}
 }
 
@@ -181,6 +192,17 @@ func (store *SQLStateStore) SetPowerLevels(roomID id.RoomID, levels *event.Power
 		store.log.Errorfln("Failed to marshal power levels of %s: %v", roomID, err)
 		return
 	}
+	var prev *event.PowerLevelsEventContent
+	var prevBytes []byte
+	if store.db.QueryRow("SELECT power_levels FROM mx_room_state WHERE room_id=$1", roomID).Scan(&prevBytes) == nil {
+		prev = &event.PowerLevelsEventContent{}
+		if json.Unmarshal(prevBytes, prev) != nil {
+			prev = nil
+		}
+	}
+	store.replacedPowerLevelsLock.Lock()
+	store.replacedPowerLevels[roomID] = replacedPowerLevels{prev, levels}
+	store.replacedPowerLevelsLock.Unlock()
 	if store.db.dialect == "postgres" {
 		_, err = store.db.Exec(`INSERT INTO mx_room_state (room_id, power_levels) VALUES ($1, $2)
 			ON CONFLICT (room_id) DO UPDATE SET power_levels=$2`, roomID, levelsBytes)
@@ -194,6 +216,20 @@ func (store *SQLStateStore) SetPowerLevels(roomID id.RoomID, levels *event.Power
 	}
 }
 
+// GetReplacedPowerLevels returns the power levels of the room from before they were replaced with the given levels.
+// The appservice stores the power levels of incoming events before they're handled, so GetPowerLevels already
+// returns the new levels in event handlers. This returns nil if the previous levels weren't stored or if the
+// levels have been replaced again since.
+func (store *SQLStateStore) GetReplacedPowerLevels(roomID id.RoomID, levels *event.PowerLevelsEventContent) *event.PowerLevelsEventContent {
+	store.replacedPowerLevelsLock.Lock()
+	defer store.replacedPowerLevelsLock.Unlock()
+	replaced, ok := store.replacedPowerLevels[roomID]
+	if !ok || replaced.new != levels {
+		return nil
+	}
+	return replaced.prev
+}
+
 func (store *SQLStateStore) GetPowerLevels(roomID id.RoomID) (levels *event.PowerLevelsEventContent) {
 	row := store.db.QueryRow("SELECT power_levels FROM mx_room_state WHERE room_id=$1", roomID)
 	if row == nil {
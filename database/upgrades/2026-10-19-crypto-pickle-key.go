@@ -0,0 +1,14 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[25] = upgrade{"Add crypto store pickle key check", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`CREATE TABLE crypto_pickle_key (
+			key_check CHAR(64) NOT NULL
+		)`)
+		return err
+	}}
+}
@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[22] = upgrade{"Add Skype group description to portals", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE portal ADD COLUMN description TEXT NOT NULL DEFAULT ''`)
+		return err
+	}}
+}
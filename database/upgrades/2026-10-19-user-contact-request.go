@@ -0,0 +1,19 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[23] = upgrade{"Add table for announced contact requests", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`CREATE TABLE user_contact_request (
+			user_mxid   VARCHAR(255),
+			mri         VARCHAR(255),
+			invite_time VARCHAR(255) NOT NULL,
+
+			PRIMARY KEY (user_mxid, mri),
+			FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON DELETE CASCADE
+		)`)
+		return err
+	}}
+}
@@ -0,0 +1,21 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[21] = upgrade{"Replace filtering community meta with personal filtering space", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE "user" ADD COLUMN space_room VARCHAR(255)`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`ALTER TABLE user_portal RENAME COLUMN in_community TO in_space`)
+		if err != nil {
+			return err
+		}
+		// Portals that were in the community haven't been added to the space yet.
+		_, err = tx.Exec(`UPDATE user_portal SET in_space=false`)
+		return err
+	}}
+}
@@ -27,7 +27,7 @@ func (uq *UserQuery) New() *User {
 }
 
 func (uq *UserQuery) GetAll() (users []*User) {
-	rows, err := uq.db.Query(`SELECT mxid, jid, management_room, last_connection, endpoint_id, skype_token, registration_token, registration_token_str, location_host FROM "user"`)
+	rows, err := uq.db.Query(`SELECT mxid, jid, management_room, last_connection, endpoint_id, skype_token, registration_token, registration_token_str, location_host, space_room FROM "user"`)
 	if err != nil || rows == nil {
 		return nil
 	}
@@ -39,7 +39,7 @@ func (uq *UserQuery) GetAll() (users []*User) {
 }
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	row := uq.db.QueryRow(`SELECT mxid, jid, management_room, last_connection, endpoint_id, skype_token, registration_token, registration_token_str, location_host FROM "user" WHERE mxid=$1`, userID)
+	row := uq.db.QueryRow(`SELECT mxid, jid, management_room, last_connection, endpoint_id, skype_token, registration_token, registration_token_str, location_host, space_room FROM "user" WHERE mxid=$1`, userID)
 	if row == nil {
 		return nil
 	}
@@ -47,7 +47,7 @@ func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
 }
 
 func (uq *UserQuery) GetByJID(userID types.SkypeID) *User {
-	row := uq.db.QueryRow(`SELECT mxid, jid, management_room, last_connection, endpoint_id, skype_token, registration_token, registration_token_str, location_host FROM "user" WHERE jid=$1`, stripSuffix(userID))
+	row := uq.db.QueryRow(`SELECT mxid, jid, management_room, last_connection, endpoint_id, skype_token, registration_token, registration_token_str, location_host, space_room FROM "user" WHERE jid=$1`, stripSuffix(userID))
 	if row == nil {
 		return nil
 	}
@@ -77,17 +77,19 @@ type User struct {
 	ManagementRoom id.RoomID
 	Session        *skype.Session
 	LastConnection uint64
+	SpaceRoom      id.RoomID
 }
 
 func (user *User) Scan(row Scannable) *User {
-	var jid, endpointId, skypeToken, registrationToken, registrationTokenStr, locationHost sql.NullString
-	err := row.Scan(&user.MXID, &jid, &user.ManagementRoom, &user.LastConnection, &endpointId, &skypeToken, &registrationToken, &registrationTokenStr, &locationHost)
+	var jid, endpointId, skypeToken, registrationToken, registrationTokenStr, locationHost, spaceRoom sql.NullString
+	err := row.Scan(&user.MXID, &jid, &user.ManagementRoom, &user.LastConnection, &endpointId, &skypeToken, &registrationToken, &registrationTokenStr, &locationHost, &spaceRoom)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			user.log.Errorln("Database scan failed:", err)
 		}
 		return nil
 	}
+	user.SpaceRoom = id.RoomID(spaceRoom.String)
 	if len(jid.String) > 0 && len(endpointId.String) > 0 {
 		user.JID = jid.String + skypeExt.NewUserSuffix
 		user.Session = &skype.Session{
@@ -124,6 +126,13 @@ func (user *User) jidPtr() *string {
 	return nil
 }
 
+func (user *User) spaceRoomPtr() *id.RoomID {
+	if len(user.SpaceRoom) > 0 {
+		return &user.SpaceRoom
+	}
+	return nil
+}
+
 func (user *User) sessionUnptr() (sess skype.Session) {
 	if user.Session != nil {
 		sess = *user.Session
@@ -133,10 +142,11 @@ func (user *User) sessionUnptr() (sess skype.Session) {
 
 func (user *User) Insert() {
 	sess := user.sessionUnptr()
-	_, err := user.db.Exec(`INSERT INTO "user" (mxid, jid, management_room, last_connection, endpoint_id, skype_token, registration_token, registration_token_str, location_host) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+	_, err := user.db.Exec(`INSERT INTO "user" (mxid, jid, management_room, last_connection, endpoint_id, skype_token, registration_token, registration_token_str, location_host, space_room) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
 		user.MXID, user.jidPtr(),
 		user.ManagementRoom, user.LastConnection,
-		sess.EndpointId, sess.SkypeToken, sess.RegistrationToken, sess.RegistrationTokenStr, sess.LocationHost)
+		sess.EndpointId, sess.SkypeToken, sess.RegistrationToken, sess.RegistrationTokenStr, sess.LocationHost,
+		user.spaceRoomPtr())
 	if err != nil {
 		user.log.Warnfln("Failed to insert %s: %v", user.MXID, err)
 	}
@@ -153,10 +163,10 @@ func (user *User) UpdateLastConnection() {
 
 func (user *User) Update() {
 	sess := user.sessionUnptr()
-	_, err := user.db.Exec(`UPDATE "user" SET jid=$1, management_room=$2, last_connection=$3, endpoint_id=$4, skype_token=$5, registration_token=$6, registration_token_str=$7, location_host=$8 WHERE mxid=$9`,
+	_, err := user.db.Exec(`UPDATE "user" SET jid=$1, management_room=$2, last_connection=$3, endpoint_id=$4, skype_token=$5, registration_token=$6, registration_token_str=$7, location_host=$8, space_room=$9 WHERE mxid=$10`,
 		user.jidPtr(), user.ManagementRoom, user.LastConnection,
 		sess.EndpointId, sess.SkypeToken, sess.RegistrationToken, sess.RegistrationTokenStr, sess.LocationHost,
-		user.MXID)
+		user.spaceRoomPtr(), user.MXID)
 	if err != nil {
 		user.log.Warnfln("Failed to update %s: %v", user.MXID, err)
 	}
@@ -164,7 +174,7 @@ func (user *User) Update() {
 
 type PortalKeyWithMeta struct {
 	PortalKey
-	InCommunity bool
+	InSpace bool
 }
 
 func (user *User) SetPortalKeys(newKeys []PortalKeyWithMeta) error {
@@ -185,9 +195,9 @@ func (user *User) SetPortalKeys(newKeys []PortalKeyWithMeta) error {
 		values[pos] = user.jidPtr()
 		values[pos+1] = key.JID
 		values[pos+2] = key.Receiver
-		values[pos+3] = key.InCommunity
+		values[pos+3] = key.InSpace
 	}
-	query := fmt.Sprintf("INSERT INTO user_portal (user_jid, portal_jid, portal_receiver, in_community) VALUES %s",
+	query := fmt.Sprintf("INSERT INTO user_portal (user_jid, portal_jid, portal_receiver, in_space) VALUES %s",
 		strings.Join(valueStrings, ", "))
 	_, err = tx.Exec(query, values...)
 	if err != nil {
@@ -199,10 +209,10 @@ func (user *User) SetPortalKeys(newKeys []PortalKeyWithMeta) error {
 
 func (user *User) CreateUserPortal(newKey PortalKeyWithMeta) {
 	user.log.Debugfln("Creating new portal %s for %s", newKey.PortalKey.JID, newKey.PortalKey.Receiver)
-	_, err := user.db.Exec(`INSERT INTO user_portal (user_jid, portal_jid, portal_receiver, in_community) VALUES ($1, $2, $3, $4)`,
+	_, err := user.db.Exec(`INSERT INTO user_portal (user_jid, portal_jid, portal_receiver, in_space) VALUES ($1, $2, $3, $4)`,
 		user.jidPtr(),
 		newKey.PortalKey.JID, newKey.PortalKey.Receiver,
-		newKey.InCommunity)
+		newKey.InSpace)
 	if err != nil {
 		user.log.Warnfln("Failed to insert %s: %v", user.MXID, err)
 	}
@@ -234,8 +244,8 @@ func (user *User) GetPortalKeys() []PortalKey {
 	return keys
 }
 
-func (user *User) GetInCommunityMap() map[PortalKey]bool {
-	rows, err := user.db.Query(`SELECT portal_jid, portal_receiver, in_community FROM user_portal WHERE user_jid=$1`, user.jidPtr())
+func (user *User) GetInSpaceMap() map[PortalKey]bool {
+	rows, err := user.db.Query(`SELECT portal_jid, portal_receiver, in_space FROM user_portal WHERE user_jid=$1`, user.jidPtr())
 	if err != nil {
 		user.log.Warnln("Failed to get user portal keys:", err)
 		return nil
@@ -243,13 +253,37 @@ func (user *User) GetInCommunityMap() map[PortalKey]bool {
 	keys := make(map[PortalKey]bool)
 	for rows.Next() {
 		var key PortalKey
-		var inCommunity bool
-		err = rows.Scan(&key.JID, &key.Receiver, &inCommunity)
+		var inSpace bool
+		err = rows.Scan(&key.JID, &key.Receiver, &inSpace)
 		if err != nil {
 			user.log.Warnln("Failed to scan row:", err)
 			continue
 		}
-		keys[key] = inCommunity
+		keys[key] = inSpace
 	}
 	return keys
 }
+
+// IsContactRequestAnnounced checks whether the contact request from the given user was already announced.
+// A request sent again later has a different time, so it's announced again.
+func (user *User) IsContactRequestAnnounced(mri, inviteTime string) bool {
+	row := user.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_contact_request WHERE user_mxid=$1 AND mri=$2 AND invite_time=$3)`, user.MXID, mri, inviteTime)
+	var exists bool
+	_ = row.Scan(&exists)
+	return exists
+}
+
+func (user *User) MarkContactRequestAnnounced(mri, inviteTime string) {
+	var err error
+	if user.db.dialect == "postgres" {
+		_, err = user.db.Exec(`INSERT INTO user_contact_request (user_mxid, mri, invite_time) VALUES ($1, $2, $3)
+			ON CONFLICT (user_mxid, mri) DO UPDATE SET invite_time=$3`, user.MXID, mri, inviteTime)
+	} else if user.db.dialect == "sqlite3" {
+		_, err = user.db.Exec("INSERT OR REPLACE INTO user_contact_request (user_mxid, mri, invite_time) VALUES ($1, $2, $3)", user.MXID, mri, inviteTime)
+	} else {
+		err = fmt.Errorf("unsupported dialect %s", user.db.dialect)
+	}
+	if err != nil {
+		user.log.Warnfln("Failed to mark contact request from %s to %s as announced: %v", mri, user.MXID, err)
+	}
+}
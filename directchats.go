@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// updateDirectChats loads the m.direct account data of the user, lets the callback modify it
+// and saves it back. It's a no-op for users without double puppeting.
+func (user *User) updateDirectChats(update func(chats map[id.UserID][]id.RoomID) bool) {
+	intent := user.customIntent()
+	if intent == nil {
+		return
+	}
+	chats := make(map[id.UserID][]id.RoomID)
+	err := intent.GetAccountData(event.AccountDataDirectChats.Type, &chats)
+	if errors.Is(err, mautrix.MNotFound) {
+		user.log.Debugln("No m.direct list found, starting from an empty one")
+		chats = make(map[id.UserID][]id.RoomID)
+	} else if err != nil {
+		// Don't risk overwriting the whole list if fetching it failed for some other reason
+		user.log.Warnln("Failed to get m.direct list:", err)
+		return
+	}
+	if !update(chats) {
+		return
+	}
+	err = intent.SetAccountData(event.AccountDataDirectChats.Type, &chats)
+	if err != nil {
+		user.log.Warnln("Failed to update m.direct list:", err)
+	}
+}
+
+func removeRoomID(rooms []id.RoomID, roomID id.RoomID) ([]id.RoomID, bool) {
+	for i, existing := range rooms {
+		if existing == roomID {
+			return append(rooms[:i], rooms[i+1:]...), true
+		}
+	}
+	return rooms, false
+}
+
+func (user *User) addDirectChat(userID id.UserID, roomID id.RoomID) {
+	user.updateDirectChats(func(chats map[id.UserID][]id.RoomID) bool {
+		for _, existing := range chats[userID] {
+			if existing == roomID {
+				return false
+			}
+		}
+		chats[userID] = append(chats[userID], roomID)
+		return true
+	})
+}
+
+func (user *User) removeDirectChat(roomID id.RoomID) {
+	user.updateDirectChats(func(chats map[id.UserID][]id.RoomID) bool {
+		changed := false
+		for userID, rooms := range chats {
+			var removed bool
+			rooms, removed = removeRoomID(rooms, roomID)
+			if !removed {
+				continue
+			}
+			changed = true
+			if len(rooms) == 0 {
+				delete(chats, userID)
+			} else {
+				chats[userID] = rooms
+			}
+		}
+		return changed
+	})
+}
+
+// SyncDirectChats rebuilds the puppet entries of the m.direct list from the private chat portals of the user.
+// Entries for Matrix users that aren't Skype puppets are left untouched.
+func (user *User) SyncDirectChats() int {
+	directChats := make(map[id.UserID][]id.RoomID)
+	count := 0
+	for _, key := range user.GetPortalKeys() {
+		portal := user.bridge.GetPortalByJID(key)
+		if portal == nil || len(portal.MXID) == 0 || !portal.IsPrivateChat() {
+			continue
+		}
+		puppetID := portal.MainIntent().UserID
+		directChats[puppetID] = append(directChats[puppetID], portal.MXID)
+		count++
+	}
+	user.updateDirectChats(func(chats map[id.UserID][]id.RoomID) bool {
+		for userID := range chats {
+			if _, isPuppet := user.bridge.ParsePuppetMXID(userID); isPuppet {
+				delete(chats, userID)
+			}
+		}
+		for userID, rooms := range directChats {
+			chats[userID] = rooms
+		}
+		return true
+	})
+	return count
+}
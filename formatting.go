@@ -149,21 +149,26 @@ func (formatter *Formatter) ParseSkype(content *event.MessageEventContent, RoomM
 					msgMXID = string(msg.MXID)
 				}
 				mxid, _ = formatter.getMatrixInfoByJID("8:" + match[1] + skypeExt.NewUserSuffix)
-				href1 := fmt.Sprintf(`https://%s/#/room/%s/%s?via=%s`, formatter.bridge.Config.Homeserver.ServerName, RoomMXID, msgMXID, formatter.bridge.Config.Homeserver.Domain)
 				href2 := fmt.Sprintf(`https://%s/#/user/%s`, formatter.bridge.Config.Homeserver.ServerName, mxid)
+				content.Body = fmt.Sprintf("> <%s> %s\n\n", mxid, match[6])
+				backStr = match[7]
+				if len(msgMXID) == 0 {
+					// The quoted message has been pruned or was never bridged, so quote it without a reply relation
+					content.FormattedBody = fmt.Sprintf(`<blockquote><a href="%s">%s</a><br>%s</blockquote>`, href2, mxid, match[6])
+					continue
+				}
+				href1 := fmt.Sprintf(`https://%s/#/room/%s/%s?via=%s`, formatter.bridge.Config.Homeserver.ServerName, RoomMXID, msgMXID, formatter.bridge.Config.Homeserver.Domain)
 				newContent := fmt.Sprintf(`<mx-reply><blockquote><a href="%s">In reply to</a> <a href="%s">%s</a><br>%s</blockquote></mx-reply>`,
 					href1,
 					href2,
 					mxid,
 					match[6])
 				content.FormattedBody = newContent
-				content.Body = fmt.Sprintf("> <%s> %s\n\n", mxid, match[6])
 				inRelateTo := &event.RelatesTo{
 					Type: event.RelReply,
 					EventID: id.EventID(msgMXID),
 				}
 				content.SetRelatesTo(inRelateTo)
-				backStr = match[7]
 			}
 		}
 	}
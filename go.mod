@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/gabriel-vasile/mimetype v1.1.2
+	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/kelaresg/go-skypeapi v0.1.2-0.20210813144457-5bc29092a74e
 	github.com/lib/pq v1.9.0
@@ -101,7 +101,11 @@ func (bridge *Bridge) MigrateDatabase() {
 		os.Exit(33)
 	}
 
-	database.Migrate(oldDB, newDB)
+	err = database.Migrate(oldDB, newDB)
+	if err != nil {
+		bridge.Log.Fatalln("Failed to migrate database:", err)
+		os.Exit(34)
+	}
 }
 
 type Bridge struct {
@@ -129,11 +133,16 @@ type Bridge struct {
 	puppets             map[types.SkypeID]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
+
+	stopPruner    chan struct{}
+	prunerStopped chan struct{}
 }
 
 type Crypto interface {
 	HandleMemberEvent(*event.Event)
 	Decrypt(*event.Event) (*event.Event, error)
+	WaitForSession(id.RoomID, id.SenderKey, id.SessionID, time.Duration) bool
+	RequestSession(id.RoomID, id.SenderKey, id.SessionID, id.UserID, id.DeviceID)
 	Encrypt(id.RoomID, event.Type, event.Content) (*event.EncryptedEventContent, error)
 	Init() error
 	Start()
@@ -149,6 +158,9 @@ func NewBridge() *Bridge {
 		portalsByJID:        make(map[database.PortalKey]*Portal),
 		puppets:             make(map[types.SkypeID]*Puppet),
 		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
+
+		stopPruner:    make(chan struct{}),
+		prunerStopped: make(chan struct{}),
 	}
 
 	var err error
@@ -269,6 +281,7 @@ func (bridge *Bridge) Start() {
 		go bridge.Crypto.Start()
 	}
 	go bridge.StartUsers()
+	go bridge.StartMessagePruner()
 }
 
 func (bridge *Bridge) LoadRelaybot() {
@@ -337,6 +350,7 @@ func (bridge *Bridge) Stop() {
 	}
 	bridge.AS.Stop()
 	bridge.EventProcessor.Stop()
+	bridge.StopMessagePruner()
 	for _, user := range bridge.usersByJID {
 		if user.Conn == nil {
 			continue
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	skype "github.com/kelaresg/go-skypeapi"
 	"github.com/kelaresg/matrix-skype/database"
+	"github.com/kelaresg/matrix-skype/types"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/patch"
 
@@ -24,6 +27,8 @@ type MatrixHandler struct {
 	as     *appservice.AppService
 	log    maulogger.Logger
 	cmd    *CommandHandler
+
+	groupCreateLock sync.Mutex
 }
 
 func NewMatrixHandler(bridge *Bridge) *MatrixHandler {
@@ -42,6 +47,7 @@ func NewMatrixHandler(bridge *Bridge) *MatrixHandler {
 	bridge.EventProcessor.On(event.StateRoomAvatar, handler.HandleRoomMetadata)
 	bridge.EventProcessor.On(event.StateTopic, handler.HandleRoomMetadata)
 	bridge.EventProcessor.On(event.StateEncryption, handler.HandleEncryption)
+	bridge.EventProcessor.On(event.StatePowerLevels, handler.HandlePowerLevels)
 	return handler
 }
 
@@ -199,40 +205,175 @@ func (mx *MatrixHandler) createPrivatePortalFromInvite(roomID id.RoomID, inviter
 		mx.log.Errorln("Failed to fill history:", err)
 	}
 
-	inviter.addPortalToCommunity(portal)
-	inviter.addPuppetToCommunity(puppet)
+	inviter.addPortalToSpace(portal)
 }
 
-func (mx *MatrixHandler) HandlePuppetInvite(evt *event.Event, inviter *User, puppet *Puppet) {
-	intent := puppet.DefaultIntent()
-	members := mx.joinAndCheckMembers(evt, intent)
-	if members == nil {
-		return
+// privateChatInviteDelay is how long a room with a single invited puppet is given to receive more puppet invites
+// before it's turned into a private chat portal, unless the invite was explicitly marked as a direct chat.
+const privateChatInviteDelay = 15 * time.Second
+
+type puppetInviteAction int
+
+const (
+	inviteActionPrivate puppetInviteAction = iota
+	inviteActionGroup
+	inviteActionWait
+	inviteActionLeave
+	inviteActionInactive
+)
+
+// choosePuppetInviteAction decides what a room becomes after a puppet is invited to it. A room with one puppet
+// might still get more puppets invited one by one, so it's only treated as a private chat if the invite was
+// marked as direct or if no other puppets were invited within privateChatInviteDelay.
+func choosePuppetInviteAction(puppets int, isDirect, waited, hasBridgeBot, hasOtherUsers bool) puppetInviteAction {
+	if !hasOtherUsers && puppets >= 2 {
+		return inviteActionGroup
+	} else if !hasBridgeBot && !hasOtherUsers {
+		if isDirect || waited {
+			return inviteActionPrivate
+		}
+		return inviteActionWait
+	} else if !hasBridgeBot {
+		return inviteActionLeave
 	}
-	var hasBridgeBot, hasOtherUsers bool
-	for mxid, _ := range members.Joined {
-		mx.log.Debugfln("HandlePuppetInvite mxid", mxid)
-		mx.log.Debugfln("HandlePuppetInvite intent.UserID", intent.UserID)
-		mx.log.Debugfln("HandlePuppetInvite patch.Parse(intent.UserID)", id.UserID(patch.Parse(string(intent.UserID))))
-		mx.log.Debugfln("HandlePuppetInvite inviter.MXID", inviter.MXID)
+	return inviteActionInactive
+}
+
+// puppetInviteParticipants finds the Skype users that are joined or invited to the room,
+// along with whether the bridge bot or any real Matrix users other than the inviter are in it.
+func (mx *MatrixHandler) puppetInviteParticipants(roomID id.RoomID, joined mautrix.Joined, inviter *User, puppet *Puppet) (participants []types.SkypeID, hasBridgeBot, hasOtherUsers bool) {
+	intent := puppet.DefaultIntent()
+	participants = []types.SkypeID{puppet.JID}
+	for mxid := range joined {
 		if mxid == id.UserID(patch.Parse(string(intent.UserID))) || mxid == inviter.MXID {
 			continue
 		} else if mxid == mx.bridge.Bot.UserID {
 			hasBridgeBot = true
+		} else if jid, isPuppet := mx.bridge.ParsePuppetMXID(mxid); isPuppet {
+			if jid != inviter.JID && jid != puppet.JID {
+				participants = append(participants, jid)
+			}
 		} else {
 			hasOtherUsers = true
 		}
 	}
-	if !hasBridgeBot && !hasOtherUsers {
-		key := database.NewPortalKey(puppet.JID, inviter.JID)
-		mx.handlePrivatePortal(evt.RoomID, inviter, puppet, key)
-	} else if !hasBridgeBot {
-		mx.log.Debugln("Leaving multi-user room", evt.RoomID, "as", puppet.MXID, "after accepting invite from", evt.Sender)
-		_, _ = intent.SendNotice(evt.RoomID, "Please invite the bridge bot first if you want to bridge to a skype group.")
-		_, _ = intent.LeaveRoom(evt.RoomID)
+	invited, err := intent.Members(roomID, mautrix.ReqMembers{Membership: event.MembershipInvite})
+	if err != nil {
+		mx.log.Warnfln("Failed to get invited members of %s: %v", roomID, err)
 	} else {
-		_, _ = intent.SendNotice(evt.RoomID, "This puppet will remain inactive until this room is bridged to a Skype group.")
+		for _, member := range invited.Chunk {
+			jid, isPuppet := mx.bridge.ParsePuppetMXID(id.UserID(member.GetStateKey()))
+			if isPuppet && jid != puppet.JID && jid != inviter.JID {
+				participants = append(participants, jid)
+			}
+		}
+	}
+	return
+}
+
+func (mx *MatrixHandler) HandlePuppetInvite(evt *event.Event, inviter *User, puppet *Puppet) {
+	intent := puppet.DefaultIntent()
+	members := mx.joinAndCheckMembers(evt, intent)
+	if members == nil {
+		return
+	}
+	isDirect := evt.Content.AsMember().IsDirect
+	participants, hasBridgeBot, hasOtherUsers := mx.puppetInviteParticipants(evt.RoomID, members.Joined, inviter, puppet)
+	action := choosePuppetInviteAction(len(participants), isDirect, false, hasBridgeBot, hasOtherUsers)
+	if action == inviteActionWait {
+		// Handle the rest in the background, so that the invites of the other puppets can be processed meanwhile.
+		go mx.handleDelayedPuppetInvite(evt.RoomID, inviter, puppet)
+		return
+	}
+	mx.handlePuppetInviteAction(action, evt.RoomID, inviter, puppet, participants)
+}
+
+func (mx *MatrixHandler) handleDelayedPuppetInvite(roomID id.RoomID, inviter *User, puppet *Puppet) {
+	time.Sleep(privateChatInviteDelay)
+	if mx.bridge.GetPortalByMXID(roomID) != nil {
+		// Another puppet was invited and the room was bridged to a group
+		return
+	}
+	members, err := puppet.DefaultIntent().JoinedMembers(roomID)
+	if err != nil {
+		mx.log.Warnfln("Failed to get members of %s to decide what to bridge it to: %v", roomID, err)
+		return
+	}
+	participants, hasBridgeBot, hasOtherUsers := mx.puppetInviteParticipants(roomID, members.Joined, inviter, puppet)
+	action := choosePuppetInviteAction(len(participants), false, true, hasBridgeBot, hasOtherUsers)
+	mx.handlePuppetInviteAction(action, roomID, inviter, puppet, participants)
+}
+
+func (mx *MatrixHandler) handlePuppetInviteAction(action puppetInviteAction, roomID id.RoomID, inviter *User, puppet *Puppet, participants []types.SkypeID) {
+	intent := puppet.DefaultIntent()
+	switch action {
+	case inviteActionGroup:
+		mx.createGroupPortalFromInvite(roomID, inviter, intent, participants)
+	case inviteActionPrivate:
+		mx.groupCreateLock.Lock()
+		defer mx.groupCreateLock.Unlock()
+		if mx.bridge.GetPortalByMXID(roomID) != nil {
+			return
+		}
+		key := database.NewPortalKey(puppet.JID, inviter.JID)
+		mx.handlePrivatePortal(roomID, inviter, puppet, key)
+	case inviteActionLeave:
+		mx.log.Debugln("Leaving multi-user room", roomID, "as", puppet.MXID, "after accepting invite from", inviter.MXID)
+		_, _ = intent.SendNotice(roomID, "Please invite the bridge bot first if you want to bridge to a skype group.")
+		_, _ = intent.LeaveRoom(roomID)
+	case inviteActionInactive:
+		_, _ = intent.SendNotice(roomID, "This puppet will remain inactive until this room is bridged to a Skype group.")
+	}
+}
+
+// createGroupPortalFromInvite creates a Skype group with the puppets invited to the room and binds the room to it.
+func (mx *MatrixHandler) createGroupPortalFromInvite(roomID id.RoomID, inviter *User, intent *appservice.IntentAPI, participants []types.SkypeID) {
+	// Every invited puppet ends up here, only the first one creates the group.
+	mx.groupCreateLock.Lock()
+	defer mx.groupCreateLock.Unlock()
+	if mx.bridge.GetPortalByMXID(roomID) != nil {
+		return
+	}
+
+	var roomNameEvent event.RoomNameEventContent
+	err := intent.StateEvent(roomID, event.StateRoomName, "", &roomNameEvent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		mx.log.Warnfln("Failed to get name of %s: %v", roomID, err)
+	}
+	name := roomNameEvent.Name
+	if len(name) == 0 {
+		names := make([]string, 0, len(participants))
+		for _, jid := range participants {
+			names = append(names, mx.bridge.GetPuppetByJID(jid).Displayname)
+		}
+		name = strings.Join(names, ", ")
+	}
+	var encryptionEvent event.EncryptionEventContent
+	err = intent.StateEvent(roomID, event.StateEncryption, "", &encryptionEvent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		mx.log.Warnfln("Failed to get encryption status of %s: %v", roomID, err)
+	}
+
+	// Group portals are managed by the bridge bot, so it has to be in the room.
+	_, err = intent.InviteUser(roomID, &mautrix.ReqInviteUser{UserID: mx.bridge.Bot.UserID})
+	if err != nil {
+		mx.log.Debugfln("Failed to invite bridge bot to %s: %v", roomID, err)
+	}
+	err = mx.bridge.Bot.EnsureJoined(roomID)
+	if err != nil {
+		mx.log.Warnfln("Failed to join %s as bridge bot: %v", roomID, err)
+		_, _ = intent.SendNotice(roomID, "Please invite the bridge bot first if you want to bridge to a skype group.")
+		return
+	}
+
+	mx.log.Infoln("Creating Skype group for", roomID, "after invite from", inviter.MXID)
+	portal, err := inviter.createGroupForRoom(roomID, name, participants, encryptionEvent.Algorithm == id.AlgorithmMegolmV1)
+	if err != nil {
+		mx.log.Errorfln("Failed to create Skype group for %s: %v", roomID, err)
+		_, _ = intent.SendNotice(roomID, fmt.Sprintf("Failed to create Skype group: %v", err))
+		return
 	}
+	_, _ = portal.MainIntent().SendNotice(roomID, "Successfully created Skype group "+portal.Key.JID)
 }
 
 func (mx *MatrixHandler) HandleMembership(evt *event.Event) {
@@ -269,7 +410,9 @@ func (mx *MatrixHandler) HandleMembership(evt *event.Event) {
 	mx.log.Debugfln("HandleMembership isSelf:", isSelf)
 	mx.log.Debugfln("HandleMembership id.UserID(evt.GetStateKey()):", id.UserID(evt.GetStateKey()))
 	mx.log.Debugfln("HandleMembership evt.Sender:", evt.Sender)
-	if content.Membership == event.MembershipLeave {
+	if content.Membership == event.MembershipBan && !isSelf {
+		portal.HandleMatrixBan(user, evt)
+	} else if content.Membership == event.MembershipLeave {
 		if id.UserID(evt.GetStateKey()) == evt.Sender {
 			if evt.Unsigned.PrevContent != nil {
 				_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
@@ -286,13 +429,30 @@ func (mx *MatrixHandler) HandleMembership(evt *event.Event) {
 			mx.log.Debugfln("HandleMembership event.MembershipLeave", event.MembershipLeave)
 			mx.log.Debugfln("HandleMembership user.", event.MembershipLeave)
 			//mx.as.StateStore.SetMembership(evt.RoomID, id.UserID(evt.GetStateKey()), event.MembershipLeave)
-			portal.HandleMatrixKick(user, evt)
+			if prevMembership(evt) == event.MembershipBan {
+				portal.HandleMatrixUnban(user, evt)
+			} else {
+				portal.HandleMatrixKick(user, evt)
+			}
 		}
 	} else if content.Membership == event.MembershipInvite && !isSelf {
 		portal.HandleMatrixInvite(user, evt)
 	}
 }
 
+// prevMembership returns the membership the target of the member event had before it.
+func prevMembership(evt *event.Event) event.Membership {
+	if evt.Unsigned.PrevContent == nil {
+		return ""
+	}
+	_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+	prevContent, ok := evt.Unsigned.PrevContent.Parsed.(*event.MemberEventContent)
+	if !ok {
+		return ""
+	}
+	return prevContent.Membership
+}
+
 func (mx *MatrixHandler) HandleRoomMetadata(evt *event.Event) {
 	user := mx.bridge.GetUserByMXID(evt.Sender)
 	if user == nil || !user.Whitelisted || !user.IsConnected() {
@@ -313,10 +473,17 @@ func (mx *MatrixHandler) HandleRoomMetadata(evt *event.Event) {
 			"topic": content.Name,
 		})
 	case *event.TopicEventContent:
-		//resp, err = user.Conn.SetConversationThreads(portal.Key.JID, map[string]string{
-		//	"topic": content.Topic,
-		//})
-		return
+		if content.Topic == portal.Description {
+			return
+		}
+		resp, err = user.Conn.SetConversationThreads(portal.Key.JID, map[string]string{
+			"description": content.Topic,
+		})
+		if err == nil {
+			portal.Topic = content.Topic
+			portal.Description = content.Topic
+			portal.Update()
+		}
 	case *event.RoomAvatarEventContent:
 		data, err := portal.MainIntent().DownloadBytes(content.URL)
 		if err != nil {
@@ -350,6 +517,21 @@ func (mx *MatrixHandler) HandleRoomMetadata(evt *event.Event) {
 	}
 }
 
+func (mx *MatrixHandler) HandlePowerLevels(evt *event.Event) {
+	if _, isPuppet := mx.bridge.ParsePuppetMXID(evt.Sender); evt.Sender == mx.bridge.Bot.UserID || isPuppet {
+		return
+	}
+	portal := mx.bridge.GetPortalByMXID(evt.RoomID)
+	if portal == nil || portal.IsPrivateChat() {
+		return
+	}
+	user := mx.bridge.GetUserByMXID(evt.Sender)
+	if user == nil || !user.Whitelisted {
+		return
+	}
+	portal.HandleMatrixPowerLevels(user, evt)
+}
+
 func (mx *MatrixHandler) shouldIgnoreEvent(evt *event.Event) bool {
 	if _, isPuppet := mx.bridge.ParsePuppetMXID(evt.Sender); evt.Sender == mx.bridge.Bot.UserID || isPuppet {
 		mx.log.Debugfln("shouldIgnoreEvent: isPuppet=%+v, evt.Sender=%+v", isPuppet, evt.Sender)
@@ -376,13 +558,65 @@ func (mx *MatrixHandler) HandleEncrypted(evt *event.Event) {
 	}
 
 	decrypted, err := mx.bridge.Crypto.Decrypt(evt)
+	if errors.Is(err, NoSessionFound) {
+		content := evt.Content.AsEncrypted()
+		mx.log.Debugfln("Couldn't find session %s trying to decrypt %s, waiting %d seconds...", content.SessionID, evt.ID, int(sessionWaitTimeout.Seconds()))
+		if mx.bridge.Crypto.WaitForSession(evt.RoomID, content.SenderKey, content.SessionID, sessionWaitTimeout) {
+			mx.log.Debugfln("Got session %s after waiting, trying to decrypt %s again", content.SessionID, evt.ID)
+			decrypted, err = mx.bridge.Crypto.Decrypt(evt)
+		} else {
+			go mx.waitLongerForSession(evt)
+			return
+		}
+	}
 	if err != nil {
 		mx.log.Warnfln("Failed to decrypt %s: %v", evt.ID, err)
+		mx.sendDecryptionFailure(evt)
 		return
 	}
 	mx.bridge.EventProcessor.Dispatch(decrypted)
 }
 
+const sessionWaitTimeout = 3 * time.Second
+const extendedSessionWaitTimeout = 22 * time.Second
+
+// waitLongerForSession requests the missing Megolm session from the sender's devices
+// and tells the sender if it still doesn't arrive in time.
+func (mx *MatrixHandler) waitLongerForSession(evt *event.Event) {
+	content := evt.Content.AsEncrypted()
+	mx.log.Debugfln("Couldn't find session %s trying to decrypt %s, requesting keys and waiting %d more seconds...", content.SessionID, evt.ID, int(extendedSessionWaitTimeout.Seconds()))
+	mx.bridge.Crypto.RequestSession(evt.RoomID, content.SenderKey, content.SessionID, evt.Sender, content.DeviceID)
+
+	if !mx.bridge.Crypto.WaitForSession(evt.RoomID, content.SenderKey, content.SessionID, extendedSessionWaitTimeout) {
+		mx.log.Warnfln("Didn't get session %s, giving up on decrypting %s", content.SessionID, evt.ID)
+		mx.sendDecryptionFailure(evt)
+		return
+	}
+	mx.log.Debugfln("Got session %s after waiting more, trying to decrypt %s again", content.SessionID, evt.ID)
+	decrypted, err := mx.bridge.Crypto.Decrypt(evt)
+	if err != nil {
+		mx.log.Warnfln("Failed to decrypt %s: %v", evt.ID, err)
+		mx.sendDecryptionFailure(evt)
+		return
+	}
+	mx.bridge.EventProcessor.Dispatch(decrypted)
+}
+
+func (mx *MatrixHandler) sendDecryptionFailure(evt *event.Event) {
+	msg := format.RenderMarkdown(fmt.Sprintf("[%[1]s](https://matrix.to/#/%[1]s): \u26a0 "+
+		"Your message couldn't be decrypted and wasn't sent to Skype.", evt.Sender), true, false)
+	msg.MsgType = event.MsgNotice
+	var err error
+	if portal := mx.bridge.GetPortalByMXID(evt.RoomID); portal != nil {
+		_, err = portal.sendMainIntentMessage(msg)
+	} else {
+		_, err = mx.bridge.Bot.SendMessageEvent(evt.RoomID, event.EventMessage, msg)
+	}
+	if err != nil {
+		mx.log.Warnfln("Failed to send decryption error notice for %s: %v", evt.ID, err)
+	}
+}
+
 func (mx *MatrixHandler) HandleMessage(evt *event.Event) {
 	if mx.shouldIgnoreEvent(evt) {
 		return
@@ -391,30 +625,25 @@ func (mx *MatrixHandler) HandleMessage(evt *event.Event) {
 	user := mx.bridge.GetUserByMXID(evt.Sender)
 	content := evt.Content.AsMessage()
 	if user.Whitelisted && content.MsgType == event.MsgText {
+		if user.GetCommandState(evt.RoomID) != nil {
+			// Replies to interactive commands (like the login password) are passed through as is
+			mx.cmd.Handle(evt.RoomID, evt.ID, user, content.Body)
+			return
+		}
 		commandPrefix := mx.bridge.Config.Bridge.CommandPrefix
 		hasCommandPrefix := strings.HasPrefix(content.Body, commandPrefix)
 		if hasCommandPrefix {
 			content.Body = strings.TrimLeft(content.Body[len(commandPrefix):], " ")
 		}
 		if hasCommandPrefix || evt.RoomID == user.ManagementRoom {
-			mx.cmd.Handle(evt.RoomID, user, content.Body)
-			if strings.HasPrefix(content.Body,  "login") == true {
-				go func() {
-					time.Sleep(time.Second * 10)
-					customPuppet := user.bridge.GetPuppetByJID(user.JID)
-					_, err := customPuppet.customIntent.RedactEvent(evt.RoomID, evt.ID)
-					if err != nil {
-						mx.log.Debugfln("HandleMessage RedactEvent: %+v", err)
-					}
-				}()
-			}
+			mx.cmd.Handle(evt.RoomID, evt.ID, user, content.Body)
 			return
 		}
 	}
 	mx.log.Debugfln("HandleMessage evt.RoomID1: %+v", evt.RoomID)
 	portal := mx.bridge.GetPortalByMXID(evt.RoomID)
 	mx.log.Debugfln("HandleMessage portal: %+v", portal)
-	if user.Conn != nil && portal != nil && (user.Whitelisted || portal.HasRelaybot()) {
+	if portal != nil && ((user.Conn != nil && user.Whitelisted) || portal.HasRelaybot()) {
 		portal.HandleMatrixMessage(user, evt)
 	}
 }
@@ -425,8 +654,13 @@ func (mx *MatrixHandler) HandleRedaction(evt *event.Event) {
 	}
 
 	user := mx.bridge.GetUserByMXID(evt.Sender)
-
-	if !user.Whitelisted {
+	portal := mx.bridge.GetPortalByMXID(evt.RoomID)
+	if portal == nil {
+		return
+	} else if !user.Whitelisted {
+		if portal.HasRelaybot() {
+			portal.HandleMatrixRedaction(user, evt)
+		}
 		return
 	}
 
@@ -441,8 +675,7 @@ func (mx *MatrixHandler) HandleRedaction(evt *event.Event) {
 		return
 	}
 
-	portal := mx.bridge.GetPortalByMXID(evt.RoomID)
-	if user.Conn != nil && user.Conn.LoginInfo != nil && portal != nil {
+	if (user.Conn != nil && user.Conn.LoginInfo != nil) || portal.HasRelaybot() {
 		portal.HandleMatrixRedaction(user, evt)
 	}
 }
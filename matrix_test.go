@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestChoosePuppetInviteAction(t *testing.T) {
+	tests := []struct {
+		name          string
+		puppets       int
+		isDirect      bool
+		waited        bool
+		hasBridgeBot  bool
+		hasOtherUsers bool
+		want          puppetInviteAction
+	}{
+		{"direct chat invite", 1, true, false, false, false, inviteActionPrivate},
+		{"first of sequential invites", 1, false, false, false, false, inviteActionWait},
+		{"second of sequential invites", 2, false, false, false, false, inviteActionGroup},
+		{"first of sequential invites after a second one arrived", 2, false, true, false, false, inviteActionGroup},
+		{"single puppet after waiting", 1, false, true, false, false, inviteActionPrivate},
+		{"several puppets at once", 3, false, false, true, false, inviteActionGroup},
+		{"room with other users", 2, false, false, false, true, inviteActionLeave},
+		{"room with other users and the bridge bot", 1, false, false, true, true, inviteActionInactive},
+		{"single puppet with the bridge bot", 1, false, false, true, false, inviteActionInactive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := choosePuppetInviteAction(tt.puppets, tt.isDirect, tt.waited, tt.hasBridgeBot, tt.hasOtherUsers)
+			if got != tt.want {
+				t.Errorf("choosePuppetInviteAction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -36,6 +36,7 @@ import (
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 
+	"github.com/kelaresg/matrix-skype/config"
 	"github.com/kelaresg/matrix-skype/database"
 	"github.com/kelaresg/matrix-skype/types"
 )
@@ -157,6 +158,7 @@ type Portal struct {
 
 	isPrivate   *bool
 	hasRelaybot *bool
+	relayUser   *User
 }
 
 const MaxMessageAgeToCreatePortal = 5 * 60 // 5 minutes
@@ -181,7 +183,7 @@ func (portal *Portal) handleMessageLoop() {
 		} else {
 			if !msg.source.IsInPortal(portal.Key) {
 				fmt.Println("portal handleMessageLoop InPortal:")
-				msg.source.CreateUserPortal(database.PortalKeyWithMeta{PortalKey: portal.Key, InCommunity: false})
+				msg.source.CreateUserPortal(database.PortalKeyWithMeta{PortalKey: portal.Key, InSpace: false})
 			}
 		}
 		fmt.Println()
@@ -230,15 +232,26 @@ func (portal *Portal) handleMessage(msg PortalMessage) {
 }
 
 func (portal *Portal) isRecentlyHandled(id types.SkypeMessageID) bool {
-	start := portal.recentlyHandledIndex
-	for i := start; i != start; i = (i - 1) % recentlyHandledLength {
-		if portal.recentlyHandled[i] == id {
+	if len(id) == 0 {
+		return false
+	}
+	portal.recentlyHandledLock.Lock()
+	defer portal.recentlyHandledLock.Unlock()
+	for _, handled := range portal.recentlyHandled {
+		if handled == id {
 			return true
 		}
 	}
 	return false
 }
 
+func (portal *Portal) markRecentlyHandled(id types.SkypeMessageID) {
+	portal.recentlyHandledLock.Lock()
+	portal.recentlyHandled[portal.recentlyHandledIndex] = id
+	portal.recentlyHandledIndex = (portal.recentlyHandledIndex + 1) % recentlyHandledLength
+	portal.recentlyHandledLock.Unlock()
+}
+
 func (portal *Portal) isDuplicate(clientMessageId types.SkypeMessageID, id string) bool {
 	msg := portal.bridge.DB.Message.GetByJID(portal.Key, clientMessageId)
 	if msg != nil && len(msg.ID) < 1 {
@@ -305,11 +318,7 @@ func (portal *Portal) markHandledSkype(source *User, message *skype.Resource, mx
 	msg.Insert()
 	fmt.Println("markHandledSkype1", msg.Chat.JID)
 	fmt.Println("markHandledSkype2", msg.JID)
-	portal.recentlyHandledLock.Lock()
-	index := portal.recentlyHandledIndex
-	portal.recentlyHandledIndex = (portal.recentlyHandledIndex + 1) % recentlyHandledLength
-	portal.recentlyHandledLock.Unlock()
-	portal.recentlyHandled[index] = msg.JID
+	portal.markRecentlyHandled(msg.JID)
 }
 
 //func (portal *Portal) getMessageIntent(user *User, info whatsapp.MessageInfo) *appservice.IntentAPI {
@@ -372,7 +381,7 @@ func (portal *Portal) startHandlingSkype(source *User, info skype.Resource) (*ap
 	// TODO these should all be trace logs
 	if portal.lastMessageTs > uint64(info.Timestamp)+1 {
 		portal.log.Debugfln("Not handling %s: message is older (%d) than last bridge message (%d)", info.Id, info.Timestamp, portal.lastMessageTs)
-	} else if portal.isRecentlyHandled(info.Id) {
+	} else if portal.isRecentlyHandled(info.Id) || portal.isRecentlyHandled(info.ClientMessageId) {
 		portal.log.Debugfln("Not handling %s: message was recently handled", info.Id)
 	} else if portal.isDuplicate(info.ClientMessageId, info.Id) {
 		portal.log.Debugfln("Not handling %s: message is duplicate", info.ClientMessageId)
@@ -529,6 +538,16 @@ func (portal *Portal) UpdateTopic(topic string, setBy types.SkypeID) bool {
 	return false
 }
 
+// UpdateDescription bridges the Skype group description to the Matrix room topic.
+func (portal *Portal) UpdateDescription(description string, setBy types.SkypeID) bool {
+	if portal.Description == description {
+		return false
+	}
+	portal.Description = description
+	portal.UpdateTopic(description, setBy)
+	return true
+}
+
 func (portal *Portal) UpdateMetadata(user *User) bool {
 	if portal.IsPrivateChat() {
 		return false
@@ -547,6 +566,28 @@ func (portal *Portal) UpdateMetadata(user *User) bool {
 		return false
 	}
 
+	portalName := portal.groupName(user, metadata)
+	// portal.Topic = ""
+	//if metadata.Status != 0 {
+	// 401: access denied
+	// 404: group does (no longer) exist
+	// 500: ??? happens with status@broadcast
+
+	// TODO: update the room, e.g. change priority level
+	//   to send messages to moderator
+	//	return false
+	//}
+
+	portal.SyncParticipants(user, metadata)
+	update := false
+	update = portal.UpdateName(portalName, metadata.NameSetBy) || update
+	update = portal.UpdateDescription(metadata.Description, metadata.TopicSetBy) || update
+	return update
+}
+
+// groupName returns the room name for a Skype group. Groups without a name of their own
+// are named after their participants.
+func (portal *Portal) groupName(user *User, metadata *skypeExt.GroupInfo) string {
 	portalName := ""
 	noRoomTopic := false
 	names := strings.Split(metadata.Name, ", ")
@@ -581,22 +622,7 @@ func (portal *Portal) UpdateMetadata(user *User) bool {
 	} else {
 		portalName = metadata.Name
 	}
-	// portal.Topic = ""
-	//if metadata.Status != 0 {
-	// 401: access denied
-	// 404: group does (no longer) exist
-	// 500: ??? happens with status@broadcast
-
-	// TODO: update the room, e.g. change priority level
-	//   to send messages to moderator
-	//	return false
-	//}
-
-	portal.SyncParticipants(user, metadata)
-	update := false
-	update = portal.UpdateName(portalName, metadata.NameSetBy) || update
-	// update = portal.UpdateTopic(metadata.Topic, metadata.TopicSetBy) || update
-	return update
+	return portalName
 }
 
 func (portal *Portal) userMXIDAction(user *User, fn func(mxid id.UserID)) {
@@ -779,6 +805,211 @@ func (portal *Portal) ChangeAdminStatus(jids []string, setAdmin bool) {
 	}
 }
 
+// sendThreadActivityNotice tells the room who changed a Skype group setting, if enabled in the config.
+func (portal *Portal) sendThreadActivityNotice(initiator types.SkypeID, action string) {
+	if !portal.bridge.Config.Bridge.ThreadActivityNotices {
+		return
+	}
+	name := strings.TrimSuffix(initiator, skypeExt.NewUserSuffix)
+	if puppet := portal.bridge.GetPuppetByJID(initiator); puppet != nil && len(puppet.Displayname) > 0 {
+		name = puppet.Displayname
+	}
+	_, err := portal.MainIntent().SendNotice(portal.MXID, fmt.Sprintf("%s %s", name, action))
+	if err != nil {
+		portal.log.Warnln("Failed to send thread activity notice:", err)
+	}
+}
+
+func (portal *Portal) HandleSkypeRoleUpdate(content skypeExt.ChatRoleUpdateContent, initiator types.SkypeID) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	var admins, users []string
+	for _, target := range content.Targets {
+		jid := target.Id + skypeExt.NewUserSuffix
+		if strings.EqualFold(target.Role, "admin") {
+			admins = append(admins, jid)
+		} else {
+			users = append(users, jid)
+		}
+	}
+	if len(admins) > 0 {
+		portal.ChangeAdminStatus(admins, true)
+	}
+	if len(users) > 0 {
+		portal.ChangeAdminStatus(users, false)
+	}
+	for _, target := range content.Targets {
+		name := target.Id
+		if puppet := portal.bridge.GetPuppetByJID(target.Id + skypeExt.NewUserSuffix); puppet != nil && len(puppet.Displayname) > 0 {
+			name = puppet.Displayname
+		}
+		portal.sendThreadActivityNotice(initiator, fmt.Sprintf("changed the role of %s to %s", name, strings.ToLower(target.Role)))
+	}
+}
+
+// SetHistoryDisclosed makes the room history visible to new members if it is disclosed on Skype.
+func (portal *Portal) SetHistoryDisclosed(disclosed bool, initiator types.SkypeID) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	visibility := event.HistoryVisibilityJoined
+	action := "hid the chat history from new members"
+	if disclosed {
+		visibility = event.HistoryVisibilityShared
+		action = "made the chat history visible to new members"
+	}
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, event.StateHistoryVisibility, "", &event.HistoryVisibilityEventContent{HistoryVisibility: visibility})
+	if err != nil {
+		portal.log.Warnln("Failed to change history visibility:", err)
+		return
+	}
+	portal.sendThreadActivityNotice(initiator, action)
+}
+
+// HandleSkypeJoiningEnabled tells the room when joining the Skype group via link is toggled.
+// The Matrix room stays invite-only either way, since the link only lets people join on Skype.
+func (portal *Portal) HandleSkypeJoiningEnabled(enabled bool, initiator types.SkypeID) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	if enabled {
+		portal.sendThreadActivityNotice(initiator, "enabled joining the group via link. Matrix users still need an invite to join this room.")
+	} else {
+		portal.sendThreadActivityNotice(initiator, "disabled joining the group via link")
+	}
+}
+
+// HandleSkypePinnedMessage mirrors the pinned message of the Skype group in the pinned events of the room.
+// Skype groups only have one pinned message, so a previously pinned Skype message is unpinned first.
+// An empty message ID means the message was unpinned.
+func (portal *Portal) HandleSkypePinnedMessage(messageID string, initiator types.SkypeID) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	pinned := event.PinnedEventsEventContent{}
+	_ = portal.MainIntent().StateEvent(portal.MXID, event.StatePinnedEvents, "", &pinned)
+	var msg *database.Message
+	if len(messageID) > 0 {
+		msg = portal.bridge.DB.Message.GetByJID(portal.Key, messageID)
+		if msg == nil {
+			portal.log.Debugln("Pinned message", messageID, "not found in database")
+		}
+	}
+	newPinned := make([]id.EventID, 0, len(pinned.Pinned)+1)
+	for _, evtID := range pinned.Pinned {
+		if msg != nil && evtID == msg.MXID {
+			continue
+		} else if existing := portal.bridge.DB.Message.GetByMXID(evtID); existing != nil && existing.Chat == portal.Key {
+			continue
+		}
+		newPinned = append(newPinned, evtID)
+	}
+	if msg != nil {
+		newPinned = append(newPinned, msg.MXID)
+	}
+	if !samePinnedEvents(pinned.Pinned, newPinned) {
+		pinned.Pinned = newPinned
+		_, err := portal.MainIntent().SendStateEvent(portal.MXID, event.StatePinnedEvents, "", &pinned)
+		if err != nil {
+			portal.log.Warnln("Failed to update pinned events:", err)
+			return
+		}
+	}
+	if len(messageID) == 0 {
+		portal.sendThreadActivityNotice(initiator, "unpinned the message")
+	} else {
+		portal.sendThreadActivityNotice(initiator, "pinned a message")
+	}
+}
+
+func samePinnedEvents(a, b []id.EventID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// getSkypeIDForMatrixUser finds the Skype user behind a puppet, custom puppet or bridge user.
+func (portal *Portal) getSkypeIDForMatrixUser(userID id.UserID) (types.SkypeID, bool) {
+	if jid, ok := portal.bridge.ParsePuppetMXID(userID); ok {
+		return jid, true
+	} else if puppet := portal.bridge.GetPuppetByCustomMXID(userID); puppet != nil {
+		return puppet.JID, true
+	} else if user := portal.bridge.DB.User.GetByMXID(userID); user != nil && len(user.JID) > 0 {
+		return user.JID, true
+	}
+	return "", false
+}
+
+// HandleMatrixPowerLevels promotes or demotes the Skype group members whose power level crossed
+// the level required to change the room's power levels. Changes that Skype refuses are reverted.
+func (portal *Portal) HandleMatrixPowerLevels(sender *User, evt *event.Event) {
+	levels := evt.Content.AsPowerLevels()
+	prevLevels := portal.bridge.StateStore.GetReplacedPowerLevels(portal.MXID, levels)
+	if prevLevels == nil && evt.Unsigned.PrevContent != nil {
+		_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+		prevLevels, _ = evt.Unsigned.PrevContent.Parsed.(*event.PowerLevelsEventContent)
+	}
+	if prevLevels == nil {
+		portal.log.Debugln("No previous power levels for", evt.ID, "- not bridging power level change")
+		return
+	}
+	prevAdminLevel := prevLevels.GetEventLevel(event.StatePowerLevels)
+	adminLevel := levels.GetEventLevel(event.StatePowerLevels)
+
+	userIDs := make(map[id.UserID]struct{})
+	for userID := range prevLevels.Users {
+		userIDs[userID] = struct{}{}
+	}
+	for userID := range levels.Users {
+		userIDs[userID] = struct{}{}
+	}
+
+	var failed []string
+	for userID := range userIDs {
+		prevLevel := prevLevels.GetUserLevel(userID)
+		isAdmin := levels.GetUserLevel(userID) >= adminLevel
+		if (prevLevel >= prevAdminLevel) == isAdmin {
+			continue
+		}
+		jid, ok := portal.getSkypeIDForMatrixUser(userID)
+		if !ok {
+			continue
+		}
+		role := "User"
+		if isAdmin {
+			role = "Admin"
+		}
+		var err error
+		if sender.Conn == nil || !sender.Conn.LoggedIn {
+			err = errors.New("you're not logged into Skype")
+		} else {
+			portal.log.Debugfln("%s changed the role of %s to %s", sender.MXID, jid, role)
+			member := skype.Member{Id: strings.TrimSuffix(jid, skypeExt.NewUserSuffix), Role: role}
+			err = sender.Conn.AddMember(skype.Members{Members: []skype.Member{member}}, portal.Key.JID)
+		}
+		if err != nil {
+			portal.log.Warnfln("Failed to change the Skype role of %s to %s: %v", jid, role, err)
+			levels.SetUserLevel(userID, prevLevel)
+			failed = append(failed, fmt.Sprintf("%s (%v)", userID, err))
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	_, err := portal.MainIntent().SetPowerLevels(portal.MXID, levels)
+	if err != nil {
+		portal.log.Errorln("Failed to revert power levels:", err)
+	}
+	_, _ = portal.MainIntent().SendNotice(portal.MXID, "Failed to change Skype group roles, reverted the power levels of "+strings.Join(failed, ", "))
+}
+
 //func (portal *Portal) membershipRemove(jids []string, action skypeExt.ChatActionType) {
 //	for _, jid := range jids {
 //		jidArr := strings.Split(jid, "@c.")
@@ -801,6 +1032,7 @@ func (portal *Portal) membershipRemove(content string) {
 	xmlFormat := skype.XmlDeleteMember{}
 	err := xml.Unmarshal([]byte(content), &xmlFormat)
 	for _, target := range xmlFormat.Targets {
+		portal.handleRelayUserLeft(strings.TrimSuffix(target, skypeExt.NewUserSuffix) + skypeExt.NewUserSuffix)
 		member := portal.bridge.GetPuppetByJID(target)
 		memberMXID := id.UserID(patch.Parse(string(member.MXID)))
 		if portal.bridge.AS.StateStore.IsInRoom(portal.MXID, memberMXID) {
@@ -1045,6 +1277,8 @@ type BridgeInfoContent struct {
 	Protocol  BridgeInfoSection  `json:"protocol"`
 	Network   *BridgeInfoSection `json:"network,omitempty"`
 	Channel   BridgeInfoSection  `json:"channel"`
+
+	RelayUser id.UserID `json:"com.github.kelaresg.skype.relay_user,omitempty"`
 }
 
 var (
@@ -1067,6 +1301,7 @@ func (portal *Portal) getBridgeInfo() (string, BridgeInfoContent) {
 			DisplayName: portal.Name,
 			AvatarURL:   portal.AvatarURL.CUString(),
 		},
+		RelayUser: portal.RelayUserID,
 	}
 	// bridgeInfoStateKey := fmt.Sprintf("net.maunium.whatsapp://whatsapp/%s", portal.Key.JID) ??
 	bridgeInfoStateKey := portal.Key.JID
@@ -1090,6 +1325,31 @@ func (portal *Portal) UpdateBridgeInfo() {
 	}
 }
 
+// EnableEncryption turns on end-to-bridge encryption in an existing portal room.
+func (portal *Portal) EnableEncryption() error {
+	intent := portal.MainIntent()
+	if intent.UserID != portal.bridge.Bot.UserID {
+		_, err := intent.InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: portal.bridge.Bot.UserID})
+		if err != nil {
+			// The bot may already be in the room, so only a failed join is fatal
+			portal.log.Debugln("Failed to invite bridge bot to enable e2be:", err)
+		}
+	}
+	// The bridge bot has to be in the room for the crypto helper to share keys with the members
+	err := portal.bridge.Bot.EnsureJoined(portal.MXID)
+	if err != nil {
+		return fmt.Errorf("failed to join the bridge bot to the room: %w", err)
+	}
+	_, err = intent.SendStateEvent(portal.MXID, event.StateEncryption, "", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+	if err != nil {
+		return fmt.Errorf("failed to send encryption event: %w", err)
+	}
+	portal.Encrypted = true
+	portal.Update()
+	portal.UpdateBridgeInfo()
+	return nil
+}
+
 func (portal *Portal) CreateMatrixRoom(user *User) error {
 	portal.roomCreateLock.Lock()
 	defer portal.roomCreateLock.Unlock()
@@ -1156,8 +1416,8 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 					return errors.New("It looks like a room is being created in the matrix using command 'create', so there is no need to create a new room here.")
 				}
 			}
-			// portal.Topic = metadata.Topic
-			portal.Topic = ""
+			portal.Topic = metadata.Description
+			portal.Description = metadata.Description
 		}
 		portal.UpdateAvatar(user, nil)
 	}
@@ -1260,11 +1520,9 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 			_ = customPuppet.CustomIntent().EnsureJoined(portal.MXID)
 		}
 	}
-	inCommunity := user.addPortalToCommunity(portal)
+	inSpace := user.addPortalToSpace(portal)
 	if portal.IsPrivateChat() {
-		puppet := user.bridge.GetPuppetByJID(portal.Key.JID)
-		user.addPuppetToCommunity(puppet)
-
+		user.addDirectChat(intent.UserID, portal.MXID)
 		if portal.bridge.Config.Bridge.Encryption.Default {
 			err = portal.bridge.Bot.EnsureJoined(portal.MXID)
 			if err != nil {
@@ -1272,7 +1530,7 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 			}
 		}
 	}
-	user.CreateUserPortal(database.PortalKeyWithMeta{PortalKey: portal.Key, InCommunity: inCommunity})
+	user.CreateUserPortal(database.PortalKeyWithMeta{PortalKey: portal.Key, InSpace: inSpace})
 	err = portal.FillInitialHistory(user)
 	if err != nil {
 		portal.log.Errorln("Failed to fill history:", err)
@@ -1280,6 +1538,53 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 	return nil
 }
 
+// BridgeMatrixRoom links an existing Matrix room to the Skype group of the portal and invites the puppets.
+// The room keeps its own name and topic unless syncMetadata is set, in which case they're replaced with Skype's.
+func (portal *Portal) BridgeMatrixRoom(user *User, roomID id.RoomID, syncMetadata bool) error {
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	if len(portal.MXID) > 0 {
+		return fmt.Errorf("the group is already bridged to %s", portal.MXID)
+	}
+
+	metadata, err := user.Conn.GetGroupMetaData(portal.Key.JID)
+	if err != nil {
+		return fmt.Errorf("failed to get group info: %w", err)
+	}
+
+	var encryptionEvent event.EncryptionEventContent
+	err = portal.bridge.Bot.StateEvent(roomID, event.StateEncryption, "", &encryptionEvent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return fmt.Errorf("failed to get room encryption status: %w", err)
+	}
+
+	portal.MXID = roomID
+	if syncMetadata {
+		portal.Name = ""
+		portal.Topic = ""
+		portal.Description = ""
+	} else {
+		// Remember Skype's current values so that only later changes on Skype are bridged to the room
+		portal.Name = portal.groupName(user, metadata)
+		portal.Topic = metadata.Description
+		portal.Description = metadata.Description
+	}
+	portal.Encrypted = encryptionEvent.Algorithm == id.AlgorithmMegolmV1
+	portal.Update()
+	portal.bridge.portalsLock.Lock()
+	portal.bridge.portalsByMXID[portal.MXID] = portal
+	portal.bridge.portalsLock.Unlock()
+
+	portal.SyncParticipants(user, metadata)
+	if syncMetadata && portal.UpdateMetadata(user) {
+		portal.Update()
+	}
+	portal.UpdateBridgeInfo()
+	inSpace := user.addPortalToSpace(portal)
+	user.CreateUserPortal(database.PortalKeyWithMeta{PortalKey: portal.Key, InSpace: inSpace})
+	return nil
+}
+
 func (portal *Portal) IsPrivateChat() bool {
 	if portal.isPrivate == nil {
 		val := !strings.HasSuffix(portal.Key.JID, skypeExt.GroupSuffix)
@@ -1288,8 +1593,46 @@ func (portal *Portal) IsPrivateChat() bool {
 	return *portal.isPrivate
 }
 
+// GetRelayUser returns the user whose Skype connection is used to relay messages of unbridged Matrix users,
+// or nil if relay mode isn't enabled in the portal.
+func (portal *Portal) GetRelayUser() *User {
+	if len(portal.RelayUserID) == 0 {
+		return nil
+	} else if portal.relayUser == nil {
+		portal.relayUser = portal.bridge.GetUserByMXID(portal.RelayUserID)
+	}
+	return portal.relayUser
+}
+
+// handleRelayUserLeft turns off relay mode if the Skype user who left the group is the relay user.
+func (portal *Portal) handleRelayUserLeft(jid types.SkypeID) {
+	if relayUser := portal.GetRelayUser(); relayUser == nil || relayUser.JID != jid {
+		return
+	}
+	relayUserID := portal.RelayUserID
+	portal.log.Infofln("Relay user %s left the group, disabling relay mode", relayUserID)
+	portal.SetRelayUser(nil)
+	_, err := portal.MainIntent().SendNotice(portal.MXID, fmt.Sprintf("Relay mode was disabled, as %s is no longer in the Skype group", relayUserID))
+	if err != nil {
+		portal.log.Warnln("Failed to send relay mode notice:", err)
+	}
+}
+
+func (portal *Portal) SetRelayUser(user *User) {
+	if user == nil {
+		portal.RelayUserID = ""
+	} else {
+		portal.RelayUserID = user.MXID
+	}
+	portal.relayUser = user
+	portal.Update()
+	portal.UpdateBridgeInfo()
+}
+
 func (portal *Portal) HasRelaybot() bool {
-	if portal.bridge.Relaybot == nil {
+	if portal.GetRelayUser() != nil {
+		return true
+	} else if portal.bridge.Relaybot == nil {
 		return false
 	} else if portal.hasRelaybot == nil {
 		val := portal.bridge.Relaybot.IsInPortal(portal.Key)
@@ -1427,11 +1770,7 @@ func (portal *Portal) HandleFakeMessage(source *User, message FakeMessage) {
 		return
 	}
 
-	portal.recentlyHandledLock.Lock()
-	index := portal.recentlyHandledIndex
-	portal.recentlyHandledIndex = (portal.recentlyHandledIndex + 1) % recentlyHandledLength
-	portal.recentlyHandledLock.Unlock()
-	portal.recentlyHandled[index] = message.ID
+	portal.markRecentlyHandled(message.ID)
 }
 
 func (portal *Portal) sendMainIntentMessage(content interface{}) (*mautrix.RespSendEvent, error) {
@@ -1497,6 +1836,8 @@ func (portal *Portal) HandleTextMessage(source *User, message skype.Resource) {
 					FormattedBody: content.FormattedBody,
 					Format:        content.Format,
 				}
+			} else {
+				portal.log.Debugfln("Edit target %s not found, sending edit as a new message", message.SkypeEditedId)
 			}
 		}
 		fmt.Printf("\nportal HandleTextMessage2: %+v", content)
@@ -1905,22 +2246,29 @@ func (portal *Portal) sendMatrixConnectionError(sender *User, eventID id.EventID
 	return false
 }
 
-func (portal *Portal) addRelaybotFormat(sender *User, content *event.MessageEventContent) bool {
+func (portal *Portal) addRelaybotFormat(format event.MessageType, sender *User, content *event.MessageEventContent) bool {
+	if content.Format != event.FormatHTML {
+		content.FormattedBody = strings.Replace(html.EscapeString(content.Body), "\n", "<br/>", -1)
+		content.Format = event.FormatHTML
+	}
+	content.FormattedBody = portal.formatRelayMessage(format, sender, content, content.FormattedBody)
+	return true
+}
+
+// formatRelayMessage renders a relaybot format, falling back to a plain "sender: message" line
+// if the template fails or renders nothing, so that relayed messages are never sent without a body.
+func (portal *Portal) formatRelayMessage(format event.MessageType, sender *User, content *event.MessageEventContent, message string) string {
 	member := portal.MainIntent().Member(portal.MXID, sender.MXID)
 	if len(member.Displayname) == 0 {
 		member.Displayname = string(sender.MXID)
 	}
 
-	if content.Format != event.FormatHTML {
-		content.FormattedBody = strings.Replace(html.EscapeString(content.Body), "\n", "<br/>", -1)
-		content.Format = event.FormatHTML
+	data, err := portal.bridge.Config.Bridge.Relaybot.FormatMessageAs(format, content, message, sender.MXID, member)
+	if err != nil || len(strings.TrimSpace(data)) == 0 {
+		portal.log.Warnfln("Failed to apply relaybot format %s, using fallback: %v", format, err)
+		data = fmt.Sprintf("<b>%s</b>: %s", html.EscapeString(member.Displayname), message)
 	}
-	data, err := portal.bridge.Config.Bridge.Relaybot.FormatMessage(content, sender.MXID, member)
-	if err != nil {
-		portal.log.Errorln("Failed to apply relaybot format:", err)
-	}
-	content.FormattedBody = data
-	return true
+	return data
 }
 
 func (portal *Portal) convertMatrixMessageSkype(sender *User, evt *event.Event) (*skype.SendMessage, *User, *event.MessageEventContent) {
@@ -1930,15 +2278,38 @@ func (portal *Portal) convertMatrixMessageSkype(sender *User, evt *event.Event)
 		return nil, sender, content
 	}
 
-	currentTimeNanoStr := strconv.FormatInt(time.Now().UnixNano(), 10)
-	currentTimeNanoStr = currentTimeNanoStr[:len(currentTimeNanoStr)-3]
-	clientMessageId := currentTimeNanoStr + fmt.Sprintf("%04v", rand.New(rand.NewSource(time.Now().UnixNano())).Intn(10000))
 	info := &skype.SendMessage{
-		ClientMessageId: clientMessageId,
+		ClientMessageId: newClientMessageID(),
 		Jid:             portal.Key.JID, //receiver id(conversation id)
 		Timestamp:       time.Now().Unix(),
 	}
 
+	// The relay user is picked before handling edits and replies, as those need the Skype ID of the actual sender,
+	// but the relay formatting is only applied once the content has been converted.
+	var relayedSender *User
+	relaybotFormatted := false
+	if sender.NeedsRelaybot(portal) {
+		if !portal.HasRelaybot() {
+			if sender.HasSession() {
+				portal.log.Debugln("Database says", sender.MXID, "not in chat and no relaybot, but trying to send anyway")
+			} else {
+				portal.log.Debugln("Ignoring message from", sender.MXID, "in chat with no relaybot")
+				return nil, sender, content
+			}
+		} else {
+			relayedSender = sender
+			if relayUser := portal.GetRelayUser(); relayUser != nil {
+				if relayUser.Conn == nil {
+					portal.log.Debugln("Ignoring message from", sender.MXID, "as relay user", relayUser.MXID, "is not connected")
+					return nil, sender, content
+				}
+				sender = relayUser
+			} else {
+				sender = portal.bridge.Relaybot
+			}
+		}
+	}
+
 	replyToID := content.GetReplyTo()
 
 	// reedit message
@@ -1951,6 +2322,11 @@ func (portal *Portal) convertMatrixMessageSkype(sender *User, evt *event.Event)
 		msg := portal.bridge.DB.Message.GetByMXID(content.RelatesTo.EventID)
 		if msg != nil && len(msg.JID) > 0 {
 			info.SkypeEditedId = msg.JID
+			if relayedSender != nil {
+				content.Body = strings.TrimPrefix(content.Body, " * ")
+				content.FormattedBody = strings.TrimPrefix(content.FormattedBody, " * ")
+				relaybotFormatted = portal.addRelaybotFormat(config.RelayFormatEdit, relayedSender, content)
+			}
 			//info.ClientMessageId = info.ClientMessageId + info.SkypeEditedId
 			content.Body = content.Body + fmt.Sprintf("<e_m a=\"%s\" ts_ms=\"%s\" ts=\"%s\" t=\"61\"></e_m>", a, tsMs, ts)
 			content.Body = strings.TrimPrefix(content.Body, " * ")
@@ -1958,6 +2334,8 @@ func (portal *Portal) convertMatrixMessageSkype(sender *User, evt *event.Event)
 				content.FormattedBody = content.FormattedBody + fmt.Sprintf("<e_m a=\"%s\" ts_ms=\"%s\" ts=\"%s\" t=\"61\"></e_m>", a, tsMs, ts)
 				content.FormattedBody = strings.TrimPrefix(content.FormattedBody, " * ")
 			}
+		} else {
+			portal.log.Debugfln("Edit target %s not found, sending edit as a new message", content.RelatesTo.EventID)
 		}
 
 		// in reedit message we can't obtain the "relayId" from RelatesTo.EventID cause the matrix message doesn't put it in "RelatesTo".
@@ -1995,9 +2373,24 @@ func (portal *Portal) convertMatrixMessageSkype(sender *User, evt *event.Event)
 			}
 		}
 
+		fallbackQuote := replyFallbackQuote(content.Body)
 		content.RemoveReplyFallback()
 		msg := portal.bridge.DB.Message.GetByMXID(replyToID)
-		if msg != nil && len(msg.Content) > 0 {
+		if msg == nil || len(msg.Content) == 0 {
+			// The replied-to message has been pruned or was never bridged, so there's nothing
+			// to build a Skype quote from. Keep the Matrix reply fallback as a plain quote instead.
+			if len(fallbackQuote) > 0 {
+				portal.log.Debugfln("No stored content for reply target %s, sending reply as a plain quote", replyToID)
+				if len(backStr) == 0 {
+					backStr = strings.Replace(html.EscapeString(content.Body), "\n", "<br/>", -1)
+				}
+				content.FormattedBody = strings.Replace(html.EscapeString(fallbackQuote), "\n", "<br/>", -1) + "<br/><br/>"
+				if relayedSender != nil && !relaybotFormatted {
+					backStr = portal.formatRelayMessage(config.RelayFormatReply, relayedSender, content, backStr)
+					relaybotFormatted = true
+				}
+			}
+		} else {
 			messageId := msg.ID
 			if len(messageId) < 1 {
 				messageId = strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
@@ -2023,22 +2416,19 @@ func (portal *Portal) convertMatrixMessageSkype(sender *User, evt *event.Event)
 				puppet.Displayname,
 				quoteMessage)
 			content.FormattedBody = newContent
+			if relayedSender != nil && !relaybotFormatted {
+				// The quote is kept as is, only the reply text after it gets attributed
+				if len(backStr) == 0 {
+					backStr = strings.Replace(html.EscapeString(content.Body), "\n", "<br/>", -1)
+				}
+				backStr = portal.formatRelayMessage(config.RelayFormatReply, relayedSender, content, backStr)
+				relaybotFormatted = true
+			}
 		}
 	}
 
-	relaybotFormatted := false
-	if sender.NeedsRelaybot(portal) {
-		if !portal.HasRelaybot() {
-			if sender.HasSession() {
-				portal.log.Debugln("Database says", sender.MXID, "not in chat and no relaybot, but trying to send anyway")
-			} else {
-				portal.log.Debugln("Ignoring message from", sender.MXID, "in chat with no relaybot")
-				return nil, sender, content
-			}
-		} else {
-			relaybotFormatted = portal.addRelaybotFormat(sender, content)
-			sender = portal.bridge.Relaybot
-		}
+	if relayedSender != nil && !relaybotFormatted {
+		relaybotFormatted = portal.addRelaybotFormat(content.MsgType, relayedSender, content)
 	}
 	if evt.Type == event.EventSticker {
 		content.MsgType = event.MsgImage
@@ -2141,6 +2531,16 @@ func (portal *Portal) convertMatrixMessageSkype(sender *User, evt *event.Event)
 			FileSize: strconv.FormatUint(fileSize, 10), // strconv.FormatUint(fileSize, 10),
 			Duration: 0,
 		}
+	case event.MsgLocation:
+		if !relaybotFormatted {
+			portal.log.Debugln("Unhandled Matrix event %s: locations can only be sent through the relaybot", evt.ID)
+			return nil, sender, content
+		}
+		// Skype has no location messages, so relayed locations are sent as the formatted text
+		info.Type = string(event.MsgText)
+		info.SendTextMessage = &skype.SendTextMessage{
+			Content: content.FormattedBody,
+		}
 	default:
 		portal.log.Debugln("Unhandled Matrix event %s: unknown msgtype %s", evt.ID, content.MsgType)
 		return nil, sender, content
@@ -2148,6 +2548,49 @@ func (portal *Portal) convertMatrixMessageSkype(sender *User, evt *event.Event)
 	return info, sender, content
 }
 
+func newClientMessageID() string {
+	currentTimeNanoStr := strconv.FormatInt(time.Now().UnixNano(), 10)
+	currentTimeNanoStr = currentTimeNanoStr[:len(currentTimeNanoStr)-3]
+	return currentTimeNanoStr + fmt.Sprintf("%04v", rand.New(rand.NewSource(time.Now().UnixNano())).Intn(10000))
+}
+
+// replyFallbackQuote returns the "> " prefixed quote lines at the start of a Matrix reply body.
+func replyFallbackQuote(body string) string {
+	if !strings.HasPrefix(body, "> ") {
+		return ""
+	}
+	lines := strings.Split(body, "\n")
+	var quote []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, ">") {
+			break
+		}
+		quote = append(quote, line)
+	}
+	return strings.Join(quote, "\n")
+}
+
+// sendRelayCaption sends the relaybot format of a media message as a separate text message before it,
+// as Skype media messages can't have captions.
+func (portal *Portal) sendRelayCaption(sender *User, caption string, eventID id.EventID) {
+	info := &skype.SendMessage{
+		ClientMessageId: newClientMessageID(),
+		Jid:             portal.Key.JID,
+		Timestamp:       time.Now().Unix(),
+		Type:            string(event.MsgText),
+		SendTextMessage: &skype.SendTextMessage{
+			Content: caption,
+		},
+	}
+	// The caption has no Matrix event of its own to map it to, so it's only remembered in memory to ignore the echo from Skype
+	portal.markRecentlyHandled(info.ClientMessageId)
+	errChan := make(chan error, 1)
+	portal.SendMsg(sender, portal.Key.JID, info, errChan)
+	if err := <-errChan; err != nil {
+		portal.log.Warnfln("Failed to send relaybot caption of %s: %v", eventID, err)
+	}
+}
+
 func (portal *Portal) wasMessageSent(sender *User, id string) bool {
 	//_, err := sender.Conn.LoadMessagesAfter(portal.Key.JID, id, true, 0)
 	//if err != nil {
@@ -2191,15 +2634,19 @@ func (portal *Portal) HandleMatrixMessage(sender *User, evt *event.Event) {
 		return
 	}
 	portal.log.Debugfln("Received event %s", evt.ID)
-	info, sender, _ := portal.convertMatrixMessageSkype(sender, evt)
+	matrixSender := sender
+	info, sender, evtContent := portal.convertMatrixMessageSkype(sender, evt)
 	if info == nil {
 		portal.log.Debugfln("portal HandleMatrixMessage info is nil: ")
 		return
 	}
 
 	var content string
-	if info.Type != string(event.MsgText) {
+	if info.SendMediaMessage != nil {
 		content = info.SendMediaMessage.FileName // URIObject
+		if sender != matrixSender && evtContent.Format == event.FormatHTML {
+			portal.sendRelayCaption(sender, evtContent.FormattedBody, evt.ID)
+		}
 	} else {
 		content = info.SendTextMessage.Content
 	}
@@ -2285,18 +2732,38 @@ func (portal *Portal) SendMsg(sender *User, chatThreadId string, content *skype.
 }
 
 func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
-	if portal.IsPrivateChat() && sender.JID != portal.Key.Receiver {
+	msg := portal.bridge.DB.Message.GetByMXID(evt.Redacts)
+	if msg == nil || msg.Chat != portal.Key || len(msg.ID) == 0 {
 		return
 	}
 
-	msg := portal.bridge.DB.Message.GetByMXID(evt.Redacts)
-	if msg == nil || msg.Sender != sender.JID {
+	if sender.NeedsRelaybot(portal) {
+		relayUser := portal.GetRelayUser()
+		if relayUser == nil {
+			relayUser = portal.bridge.Relaybot
+		}
+		if relayUser == nil || relayUser.Conn == nil || msg.Sender != relayUser.JID {
+			return
+		}
+		// All relayed messages have the relay user as the Skype sender, so the Matrix sender has to be checked separately
+		original, err := portal.MainIntent().GetEvent(portal.MXID, evt.Redacts)
+		if err != nil {
+			portal.log.Warnfln("Failed to get %s to check sender of relayed redaction %s: %v", evt.Redacts, evt.ID, err)
+			return
+		} else if original.Sender != evt.Sender {
+			return
+		}
+		sender = relayUser
+	} else if portal.IsPrivateChat() && sender.JID != portal.Key.Receiver {
+		return
+	} else if msg.Sender != sender.JID {
 		return
 	}
 
 	errChan := make(chan error, 1)
-	//todo  return errChan here
-	go sender.Conn.DeleteMessage(msg.Chat.JID, msg.ID)
+	go func() {
+		errChan <- sender.Conn.DeleteMessage(msg.Chat.JID, msg.ID)
+	}()
 
 	var err error
 	select {
@@ -2308,12 +2775,18 @@ func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
 	if err != nil {
 		portal.log.Errorfln("Error handling Matrix redaction %s: %v", evt.ID, err)
 	} else {
-		portal.log.Debugln("Handled Matrix redaction %s of %s", evt.ID, evt.Redacts)
+		portal.log.Debugfln("Handled Matrix redaction %s of %s", evt.ID, evt.Redacts)
 		portal.sendDeliveryReceipt(evt.ID)
 	}
 }
 
 func (portal *Portal) Delete() {
+	portal.removeFromSpaces()
+	if portal.IsPrivateChat() && len(portal.MXID) > 0 {
+		if user := portal.bridge.GetUserByJID(portal.Key.Receiver); user != nil {
+			user.removeDirectChat(portal.MXID)
+		}
+	}
 	portal.Portal.Delete()
 	portal.bridge.portalsLock.Lock()
 	delete(portal.bridge.portalsByJID, portal.Key)
@@ -2374,18 +2847,22 @@ func (portal *Portal) CleanupIfEmpty() {
 }
 
 func (portal *Portal) Cleanup(puppetsOnly bool) {
-	if len(portal.MXID) == 0 {
+	portal.cleanupRoom(portal.MXID, puppetsOnly)
+}
+
+func (portal *Portal) cleanupRoom(roomID id.RoomID, puppetsOnly bool) {
+	if len(roomID) == 0 {
 		return
 	}
 	if portal.IsPrivateChat() {
-		_, err := portal.MainIntent().LeaveRoom(portal.MXID)
+		_, err := portal.MainIntent().LeaveRoom(roomID)
 		if err != nil {
 			portal.log.Warnln("Failed to leave private chat portal with main intent:", err)
 		}
 		return
 	}
 	intent := portal.MainIntent()
-	members, err := intent.JoinedMembers(portal.MXID)
+	members, err := intent.JoinedMembers(roomID)
 	if err != nil {
 		portal.log.Errorln("Failed to get portal members for cleanup:", err)
 		return
@@ -2396,26 +2873,96 @@ func (portal *Portal) Cleanup(puppetsOnly bool) {
 		}
 		puppet := portal.bridge.GetPuppetByMXID(member)
 		if puppet != nil {
-			_, err = puppet.DefaultIntent().LeaveRoom(portal.MXID)
+			_, err = puppet.DefaultIntent().LeaveRoom(roomID)
 			if err != nil {
 				portal.log.Errorln("Error leaving as puppet while cleaning up portal:", err)
 			}
 		} else if !puppetsOnly {
-			_, err = intent.KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: member, Reason: "Deleting portal"})
+			_, err = intent.KickUser(roomID, &mautrix.ReqKickUser{UserID: member, Reason: "Deleting portal"})
 			if err != nil {
 				content := format.RenderMarkdown("Error leaving room(Deleting portal from skype), you can leave this room manually.", true, false)
 				content.MsgType = event.MsgNotice
-				_, _ = portal.MainIntent().SendMessageEvent(portal.MXID, event.EventMessage, content)
+				_, _ = portal.MainIntent().SendMessageEvent(roomID, event.EventMessage, content)
 				portal.log.Errorln("Error kicking user while cleaning up portal:", err)
 			}
 		}
 	}
-	_, err = intent.LeaveRoom(portal.MXID)
+	_, err = intent.LeaveRoom(roomID)
 	if err != nil {
 		portal.log.Errorln("Error leaving with main intent while cleaning up portal:", err)
 	}
 }
 
+// Unbridge detaches the portal from its Matrix room. The Skype puppets and the bridge
+// leave the room, but Matrix users stay so the room can keep being used.
+func (portal *Portal) Unbridge() {
+	if len(portal.MXID) > 0 {
+		stateKey, _ := portal.getBridgeInfo()
+		intent := portal.MainIntent()
+		_, err := intent.SendStateEvent(portal.MXID, StateBridgeInfo, stateKey, struct{}{})
+		if err != nil {
+			portal.log.Warnln("Failed to clear m.bridge:", err)
+		}
+		_, err = intent.SendStateEvent(portal.MXID, StateHalfShotBridgeInfo, stateKey, struct{}{})
+		if err != nil {
+			portal.log.Warnln("Failed to clear uk.half-shot.bridge:", err)
+		}
+	}
+	portal.Delete()
+	portal.Cleanup(true)
+}
+
+// Recreate replaces the Matrix room of the portal with a fresh one. The old room is
+// tombstoned and the Matrix users in it are invited to the new room.
+func (portal *Portal) Recreate(user *User) error {
+	oldMXID := portal.MXID
+	var matrixUsers []id.UserID
+	if len(oldMXID) > 0 {
+		matrixUsers, _ = portal.GetMatrixUsers()
+		portal.removeFromSpaces()
+		portal.bridge.portalsLock.Lock()
+		delete(portal.bridge.portalsByMXID, oldMXID)
+		portal.bridge.portalsLock.Unlock()
+	}
+	portal.MXID = ""
+	err := portal.CreateMatrixRoom(user)
+	if err == nil && len(portal.MXID) == 0 {
+		err = errors.New("no room was created")
+	}
+	if err != nil {
+		portal.MXID = oldMXID
+		portal.Update()
+		if len(oldMXID) > 0 {
+			portal.bridge.portalsLock.Lock()
+			portal.bridge.portalsByMXID[oldMXID] = portal
+			portal.bridge.portalsLock.Unlock()
+		}
+		return err
+	}
+	if len(oldMXID) == 0 {
+		return nil
+	}
+
+	for _, userID := range matrixUsers {
+		if userID == user.MXID {
+			continue
+		}
+		_, err = portal.MainIntent().InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: userID})
+		if err != nil {
+			portal.log.Warnfln("Failed to invite %s to recreated portal: %v", userID, err)
+		}
+	}
+	_, err = portal.MainIntent().SendStateEvent(oldMXID, event.StateTombstone, "", &event.TombstoneEventContent{
+		Body:            "This room has been replaced by a new Skype portal room",
+		ReplacementRoom: portal.MXID,
+	})
+	if err != nil {
+		portal.log.Warnln("Failed to send tombstone to old portal room:", err)
+	}
+	portal.cleanupRoom(oldMXID, true)
+	return nil
+}
+
 func (portal *Portal) HandleMatrixLeave(sender *User) {
 	if portal.IsPrivateChat() {
 		portal.log.Debugln("User left private chat portal, cleaning up and deleting...")
@@ -2447,6 +2994,60 @@ func (portal *Portal) HandleMatrixKick(sender *User, evt *event.Event) {
 	}
 }
 
+// HandleMatrixBan removes a banned puppet from the Skype group, or blocks the contact in private chats.
+func (portal *Portal) HandleMatrixBan(sender *User, evt *event.Event) {
+	if !portal.IsPrivateChat() {
+		portal.HandleMatrixKick(sender, evt)
+		return
+	}
+	jid, ok := portal.bridge.ParsePuppetMXID(id.UserID(evt.GetStateKey()))
+	if !ok {
+		return
+	}
+	err := sender.BlockContact(jid)
+	if err != nil {
+		portal.log.Errorfln("Failed to block %s as %s: %v", jid, sender.MXID, err)
+		_, _ = portal.MainIntent().SendNotice(portal.MXID, fmt.Sprintf("Failed to block contact on Skype: %v", err))
+	}
+}
+
+// HandleMatrixUnban unblocks the contact of a private chat when its puppet is unbanned,
+// and brings the puppet back into the room.
+func (portal *Portal) HandleMatrixUnban(sender *User, evt *event.Event) {
+	if !portal.IsPrivateChat() {
+		return
+	}
+	jid, ok := portal.bridge.ParsePuppetMXID(id.UserID(evt.GetStateKey()))
+	if !ok {
+		return
+	}
+	// The puppet isn't in the room after the ban, so notices before it rejoins are sent by the bridge bot
+	err := sender.UnblockContact(jid)
+	if err != nil {
+		portal.log.Errorfln("Failed to unblock %s as %s: %v", jid, sender.MXID, err)
+		_, _ = portal.bridge.Bot.SendNotice(portal.MXID, fmt.Sprintf("Failed to unblock contact on Skype: %v", err))
+		return
+	}
+
+	puppet := portal.bridge.GetPuppetByJID(jid)
+	inviter := portal.bridge.Bot
+	if customPuppet := portal.bridge.GetPuppetByCustomMXID(sender.MXID); customPuppet != nil && customPuppet.CustomIntent() != nil {
+		inviter = customPuppet.CustomIntent()
+	}
+	_, err = inviter.InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: puppet.MXID})
+	if err != nil {
+		portal.log.Warnfln("Failed to invite %s after unblocking: %v", puppet.MXID, err)
+		_, _ = portal.bridge.Bot.SendNotice(portal.MXID, "Unblocked contact on Skype, but failed to invite them back. Please invite them to this room.")
+		return
+	}
+	err = puppet.DefaultIntent().EnsureJoined(portal.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to join %s after unblocking: %v", puppet.MXID, err)
+		return
+	}
+	_, _ = portal.MainIntent().SendNotice(portal.MXID, "Unblocked contact on Skype")
+}
+
 func (portal *Portal) HandleMatrixInvite(sender *User, evt *event.Event) {
 	jid, _ := portal.bridge.ParsePuppetMXID(id.UserID(evt.GetStateKey()))
 	puppet := portal.bridge.GetPuppetByJID(jid)
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestReplyFallbackQuote(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"reply fallback", "> <@alice:example.com> hello\n\nhi there", "> <@alice:example.com> hello"},
+		{"multiline quote", "> <@alice:example.com> first\n> second\n>\n> third\n\nreply", "> <@alice:example.com> first\n> second\n>\n> third"},
+		{"quote only", "> <@alice:example.com> hello", "> <@alice:example.com> hello"},
+		{"no fallback", "just a message", ""},
+		{"quote later in body", "look at this:\n> quoted", ""},
+		{"greater than without space", ">not a quote\n\nreply", ""},
+		{"empty body", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyFallbackQuote(tt.body); got != tt.want {
+				t.Errorf("replyFallbackQuote() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// initAdmin registers the bridge admin API under the provisioning prefix.
+// The routes are reachable with the shared secret or with the OpenID token of a bridge admin.
+func (prov *ProvisioningAPI) initAdmin(r *mux.Router) {
+	r = r.PathPrefix("/admin").Subrouter()
+	r.Use(prov.AdminMiddleware)
+	r.HandleFunc("/users", prov.AdminListUsers).Methods(http.MethodGet)
+	r.HandleFunc("/users/{mxid}/logout", prov.AdminLogoutUser).Methods(http.MethodPost)
+	r.HandleFunc("/users/{mxid}/sync", prov.AdminSyncUser).Methods(http.MethodPost)
+	r.HandleFunc("/portals", prov.AdminListPortals).Methods(http.MethodGet)
+	r.HandleFunc("/portals/{room_id}", prov.AdminDeletePortal).Methods(http.MethodDelete)
+	r.HandleFunc("/portals/{room_id}/recreate", prov.AdminRecreatePortal).Methods(http.MethodPost)
+}
+
+func (prov *ProvisioningAPI) AdminMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// AuthMiddleware has already validated the token, so a request without
+		// the shared secret must come from an OpenID-authenticated user.
+		if r.Header.Get("Authorization") != "Bearer "+prov.bridge.Config.AppService.Provisioning.SharedSecret {
+			user, _ := r.Context().Value("user").(*User)
+			if user == nil || !user.Admin {
+				jsonResponse(w, http.StatusForbidden, Error{
+					Error:   "This endpoint is only available to bridge admins",
+					ErrCode: "M_FORBIDDEN",
+				})
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type AdminUserInfo struct {
+	MXID           id.UserID `json:"mxid"`
+	JID            string    `json:"jid,omitempty"`
+	ManagementRoom id.RoomID `json:"management_room,omitempty"`
+	LastConnection uint64    `json:"last_connection"`
+	HasSession     bool      `json:"has_session"`
+	Connected      bool      `json:"connected"`
+	Admin          bool      `json:"admin"`
+	Whitelisted    bool      `json:"whitelisted"`
+}
+
+type AdminPortalInfo struct {
+	JID         string    `json:"jid"`
+	Receiver    string    `json:"receiver"`
+	MXID        id.RoomID `json:"mxid,omitempty"`
+	Name        string    `json:"name"`
+	Private     bool      `json:"private"`
+	Encrypted   bool      `json:"encrypted"`
+	MemberCount int       `json:"member_count"`
+	UserCount   int       `json:"user_count"`
+}
+
+func (prov *ProvisioningAPI) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	users := prov.bridge.GetAllUsers()
+	resp := make([]AdminUserInfo, 0, len(users))
+	for _, user := range users {
+		resp = append(resp, AdminUserInfo{
+			MXID:           user.MXID,
+			JID:            user.JID,
+			ManagementRoom: user.ManagementRoom,
+			LastConnection: user.LastConnection,
+			HasSession:     user.Session != nil && len(user.Session.SkypeToken) > 0,
+			Connected:      user.Conn != nil && user.Conn.LoggedIn,
+			Admin:          user.Admin,
+			Whitelisted:    user.Whitelisted,
+		})
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"users":   resp,
+	})
+}
+
+func (prov *ProvisioningAPI) AdminListPortals(w http.ResponseWriter, r *http.Request) {
+	portals := prov.bridge.GetAllPortals()
+	resp := make([]AdminPortalInfo, 0, len(portals))
+	for _, portal := range portals {
+		info := AdminPortalInfo{
+			JID:       portal.Key.JID,
+			Receiver:  portal.Key.Receiver,
+			MXID:      portal.MXID,
+			Name:      portal.Name,
+			Private:   portal.IsPrivateChat(),
+			Encrypted: portal.Encrypted,
+			UserCount: len(portal.GetUserIDs()),
+		}
+		if len(portal.MXID) > 0 {
+			for _, member := range prov.bridge.StateStore.GetRoomMembers(portal.MXID) {
+				if member.Membership == event.MembershipJoin {
+					info.MemberCount++
+				}
+			}
+		}
+		resp = append(resp, info)
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"portals": resp,
+	})
+}
+
+func (prov *ProvisioningAPI) adminTargetUser(w http.ResponseWriter, r *http.Request) *User {
+	userID := id.UserID(mux.Vars(r)["mxid"])
+	if prov.bridge.DB.User.GetByMXID(userID) == nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "User not found",
+			ErrCode: "not found",
+		})
+		return nil
+	}
+	user := prov.bridge.GetUserByMXID(userID)
+	if user == nil || user.Conn == nil || !user.Conn.LoggedIn {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "User is not logged into Skype",
+			ErrCode: "not logged in",
+		})
+		return nil
+	}
+	return user
+}
+
+func (prov *ProvisioningAPI) AdminLogoutUser(w http.ResponseWriter, r *http.Request) {
+	user := prov.adminTargetUser(w, r)
+	if user == nil {
+		return
+	}
+	prov.log.Infoln("Force logging out", user.MXID, "via admin API")
+	user.Logout()
+	jsonResponse(w, http.StatusOK, Response{true, "Logged out successfully."})
+}
+
+func (prov *ProvisioningAPI) AdminSyncUser(w http.ResponseWriter, r *http.Request) {
+	user := prov.adminTargetUser(w, r)
+	if user == nil {
+		return
+	}
+	create := r.URL.Query().Get("create_all") == "true"
+	prov.log.Infoln("Resyncing", user.MXID, "via admin API")
+	go func() {
+		err := user.Conn.ContactList(user.Conn.UserProfile.Username)
+		if err != nil {
+			user.log.Errorln("Error get contacts:", err)
+		}
+		err = user.Conn.GetConversations("", prov.bridge.Config.Bridge.InitialChatSync)
+		if err != nil {
+			user.log.Errorln("Error get conversations:", err)
+		}
+		syncAll(user, create)
+	}()
+	jsonResponse(w, http.StatusAccepted, Response{true, "Sync started"})
+}
+
+func (prov *ProvisioningAPI) adminTargetPortal(w http.ResponseWriter, r *http.Request) *Portal {
+	portal := prov.bridge.GetPortalByMXID(id.RoomID(mux.Vars(r)["room_id"]))
+	if portal == nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Portal not found",
+			ErrCode: "not found",
+		})
+	}
+	return portal
+}
+
+func (prov *ProvisioningAPI) AdminDeletePortal(w http.ResponseWriter, r *http.Request) {
+	portal := prov.adminTargetPortal(w, r)
+	if portal == nil {
+		return
+	}
+	portal.log.Infoln("Deleting portal via admin API")
+	portal.Delete()
+	go portal.Cleanup(false)
+	jsonResponse(w, http.StatusOK, Response{true, "Portal deleted"})
+}
+
+func (prov *ProvisioningAPI) AdminRecreatePortal(w http.ResponseWriter, r *http.Request) {
+	portal := prov.adminTargetPortal(w, r)
+	if portal == nil {
+		return
+	}
+	userIDs := portal.GetUserIDs()
+	var user *User
+	for _, userID := range userIDs {
+		candidate := prov.bridge.GetUserByMXID(userID)
+		if candidate != nil && candidate.Conn != nil && candidate.Conn.LoggedIn {
+			user = candidate
+			break
+		}
+	}
+	if user == nil {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "No logged in user is in the portal, can't recreate it",
+			ErrCode: "no user",
+		})
+		return
+	}
+
+	portal.log.Infoln("Recreating portal via admin API using", user.MXID)
+	err := portal.Recreate(user)
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to create new portal room: %v", err),
+			ErrCode: "room creation failed",
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, PortalResponse{true, portal.MXID, true, portal.Key.JID})
+}
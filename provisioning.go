@@ -3,10 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	log "maunium.net/go/maulogger/v2"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
+	skype "github.com/kelaresg/go-skypeapi"
+	"github.com/kelaresg/matrix-skype/database"
+	skypeExt "github.com/kelaresg/matrix-skype/skype-ext"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -20,6 +30,7 @@ func (prov *ProvisioningAPI) Init() {
 	prov.log.Debugln("Enabling provisioning API at", prov.bridge.Config.AppService.Provisioning.Prefix)
 	r := prov.bridge.AS.Router.PathPrefix(prov.bridge.Config.AppService.Provisioning.Prefix).Subrouter()
 	r.Use(prov.AuthMiddleware)
+	prov.initAdmin(r)
 	r.HandleFunc("/ping", prov.Ping).Methods(http.MethodGet)
 	r.HandleFunc("/login", prov.Login)
 	r.HandleFunc("/logout", prov.Logout).Methods(http.MethodPost)
@@ -27,12 +38,56 @@ func (prov *ProvisioningAPI) Init() {
 	r.HandleFunc("/delete_connection", prov.DeleteConnection).Methods(http.MethodPost)
 	r.HandleFunc("/disconnect", prov.Disconnect).Methods(http.MethodPost)
 	r.HandleFunc("/reconnect", prov.Reconnect).Methods(http.MethodPost)
+	r.HandleFunc("/contacts", prov.ListContacts).Methods(http.MethodGet)
+	r.HandleFunc("/groups", prov.ListGroups).Methods(http.MethodGet)
+	r.HandleFunc("/pm/{skype_id}", prov.StartPM).Methods(http.MethodPost)
+	r.HandleFunc("/open/{conversation_id}", prov.OpenGroup).Methods(http.MethodPost)
+	r.HandleFunc("/create", prov.CreateGroup).Methods(http.MethodPost)
+	r.HandleFunc("/join", prov.JoinGroup).Methods(http.MethodPost)
+	r.HandleFunc("/sync", prov.Sync).Methods(http.MethodPost)
 }
 
+const openIDTokenPrefix = "openid:"
+
 func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			jsonResponse(w, http.StatusForbidden, map[string]interface{}{
+				"error":   "Missing auth token",
+				"errcode": "M_MISSING_TOKEN",
+			})
+			return
+		}
 		auth = auth[len("Bearer "):]
+		userID := id.UserID(r.URL.Query().Get("user_id"))
+		if prov.bridge.Config.AppService.Provisioning.AllowOpenID && strings.HasPrefix(auth, openIDTokenPrefix) {
+			verifiedUserID, err := prov.verifyOpenIDToken(auth[len(openIDTokenPrefix):])
+			if err != nil {
+				prov.log.Debugln("Failed to verify OpenID token:", err)
+				jsonResponse(w, http.StatusForbidden, map[string]interface{}{
+					"error":   "Invalid OpenID token",
+					"errcode": "M_UNKNOWN_TOKEN",
+				})
+				return
+			} else if len(userID) > 0 && userID != verifiedUserID {
+				jsonResponse(w, http.StatusForbidden, map[string]interface{}{
+					"error":   "user_id doesn't match the OpenID token owner",
+					"errcode": "M_FORBIDDEN",
+				})
+				return
+			}
+			user := prov.bridge.GetUserByMXID(verifiedUserID)
+			if user == nil || !user.Whitelisted {
+				jsonResponse(w, http.StatusForbidden, map[string]interface{}{
+					"error":   "You are not whitelisted to use this bridge",
+					"errcode": "M_FORBIDDEN",
+				})
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
+			return
+		}
 		if auth != prov.bridge.Config.AppService.Provisioning.SharedSecret {
 			jsonResponse(w, http.StatusForbidden, map[string]interface{}{
 				"error":   "Invalid auth token",
@@ -40,12 +95,47 @@ func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
 			})
 			return
 		}
-		userID := r.URL.Query().Get("user_id")
-		user := prov.bridge.GetUserByMXID(id.UserID(userID))
+		user := prov.bridge.GetUserByMXID(userID)
 		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
 	})
 }
 
+type respOpenIDUserInfo struct {
+	Sub id.UserID `json:"sub"`
+}
+
+// verifyOpenIDToken asks the homeserver who owns the given OpenID token
+// using the federation userinfo endpoint.
+func (prov *ProvisioningAPI) verifyOpenIDToken(token string) (id.UserID, error) {
+	server := prov.bridge.Config.AppService.Provisioning.OpenIDServer
+	if len(server) == 0 {
+		server = prov.bridge.Config.Homeserver.Address
+	}
+	reqURL := fmt.Sprintf("%s/_matrix/federation/v1/openid/userinfo?access_token=%s",
+		strings.TrimSuffix(server, "/"), url.QueryEscape(token))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(reqURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var info respOpenIDUserInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	_, homeserver, err := info.Sub.Parse()
+	if err != nil {
+		return "", fmt.Errorf("invalid user ID in response: %w", err)
+	} else if homeserver != prov.bridge.Config.Homeserver.Domain {
+		return "", fmt.Errorf("token belongs to %s, which is not on %s", info.Sub, prov.bridge.Config.Homeserver.Domain)
+	}
+	return info.Sub, nil
+}
+
 type Error struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error"`
@@ -343,3 +433,334 @@ func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
 	//})
 	//user.PostLogin()
 }
+
+type ContactInfo struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	RoomID id.RoomID `json:"room_id,omitempty"`
+}
+
+type GroupInfo struct {
+	ID     string    `json:"id"`
+	Topic  string    `json:"topic"`
+	RoomID id.RoomID `json:"room_id,omitempty"`
+}
+
+type PortalResponse struct {
+	Success bool      `json:"success"`
+	RoomID  id.RoomID `json:"room_id"`
+	Created bool      `json:"created"`
+	JID     string    `json:"jid"`
+}
+
+// loggedInUser returns the request user if it has an active Skype connection,
+// otherwise it writes an error response and returns nil.
+func (prov *ProvisioningAPI) loggedInUser(w http.ResponseWriter, r *http.Request) *User {
+	user, _ := r.Context().Value("user").(*User)
+	if user == nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Missing or invalid user_id",
+			ErrCode: "no user",
+		})
+		return nil
+	} else if user.Conn == nil || !user.Conn.LoggedIn {
+		jsonResponse(w, http.StatusForbidden, Error{
+			Error:   "You're not logged into Skype",
+			ErrCode: "not logged in",
+		})
+		return nil
+	}
+	return user
+}
+
+func (prov *ProvisioningAPI) portalRoomID(key database.PortalKey) id.RoomID {
+	portal := prov.bridge.DB.Portal.GetByJID(key)
+	if portal == nil {
+		return ""
+	}
+	return portal.MXID
+}
+
+func (prov *ProvisioningAPI) ListContacts(w http.ResponseWriter, r *http.Request) {
+	user := prov.loggedInUser(w, r)
+	if user == nil {
+		return
+	}
+	err := user.Conn.ContactList(user.Conn.UserProfile.Username)
+	if err != nil {
+		user.log.Warnln("Failed to get contacts:", err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to get contacts: %v", err),
+			ErrCode: "contact list failed",
+		})
+		return
+	}
+	contacts := make([]ContactInfo, 0, len(user.Conn.Store.Contacts))
+	for _, contact := range user.Conn.Store.Contacts {
+		if len(contact.PersonId) == 0 {
+			continue
+		}
+		contacts = append(contacts, ContactInfo{
+			ID:     strings.Replace(contact.PersonId, skypeExt.NewUserSuffix, "", 1),
+			Name:   contact.DisplayName,
+			RoomID: prov.portalRoomID(database.NewPortalKey(contact.PersonId, user.JID)),
+		})
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].ID < contacts[j].ID
+	})
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"contacts": contacts,
+	})
+}
+
+func (prov *ProvisioningAPI) ListGroups(w http.ResponseWriter, r *http.Request) {
+	user := prov.loggedInUser(w, r)
+	if user == nil {
+		return
+	}
+	err := user.Conn.GetConversations("", prov.bridge.Config.Bridge.InitialChatSync)
+	if err != nil {
+		user.log.Warnln("Failed to get conversations:", err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to get conversations: %v", err),
+			ErrCode: "conversation list failed",
+		})
+		return
+	}
+	groups := make([]GroupInfo, 0)
+	for jid, conversation := range user.Conn.Store.Chats {
+		if !strings.HasPrefix(jid, "19:") {
+			continue
+		}
+		groups = append(groups, GroupInfo{
+			ID:     jid,
+			Topic:  conversation.ThreadProperties.Topic,
+			RoomID: prov.portalRoomID(database.GroupPortalKey(jid)),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].ID < groups[j].ID
+	})
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"groups":  groups,
+	})
+}
+
+func (prov *ProvisioningAPI) StartPM(w http.ResponseWriter, r *http.Request) {
+	user := prov.loggedInUser(w, r)
+	if user == nil {
+		return
+	}
+	skypeID := mux.Vars(r)["skype_id"]
+	contact, ok := user.Conn.Store.Contacts[skypeID+skypeExt.NewUserSuffix]
+	if !ok {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "User ID not found in contacts. Try syncing contacts first.",
+			ErrCode: "not found",
+		})
+		return
+	}
+	puppet := prov.bridge.GetPuppetByJID(contact.PersonId)
+	puppet.Sync(user, contact)
+	portal := prov.bridge.GetPortalByJID(database.NewPortalKey(skypeID, user.JID))
+	if len(portal.MXID) > 0 {
+		_, err := portal.MainIntent().InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: user.MXID})
+		if err != nil {
+			portal.log.Debugfln("Failed to invite %s to existing portal: %v", user.MXID, err)
+		}
+		jsonResponse(w, http.StatusOK, PortalResponse{true, portal.MXID, false, portal.Key.JID})
+		return
+	}
+	err := portal.CreateMatrixRoom(user)
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to create portal room: %v", err),
+			ErrCode: "room creation failed",
+		})
+		return
+	}
+	jsonResponse(w, http.StatusCreated, PortalResponse{true, portal.MXID, true, portal.Key.JID})
+}
+
+func (prov *ProvisioningAPI) OpenGroup(w http.ResponseWriter, r *http.Request) {
+	user := prov.loggedInUser(w, r)
+	if user == nil {
+		return
+	}
+	jid := mux.Vars(r)["conversation_id"]
+	if !strings.HasSuffix(jid, skypeExt.GroupSuffix) {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "That doesn't look like a group conversation ID",
+			ErrCode: "invalid group id",
+		})
+		return
+	}
+	_ = user.Conn.GetConversations("", prov.bridge.Config.Bridge.InitialChatSync)
+	chat, ok := user.Conn.Store.Chats[jid]
+	if !ok {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Group ID not found in conversations. Try syncing first.",
+			ErrCode: "not found",
+		})
+		return
+	}
+	portal := prov.bridge.GetPortalByJID(database.GroupPortalKey(jid))
+	created := len(portal.MXID) == 0
+	portal.SyncSkype(user, chat)
+	if len(portal.MXID) == 0 {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to create portal room",
+			ErrCode: "room creation failed",
+		})
+		return
+	}
+	_, _ = portal.MainIntent().InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: user.MXID})
+	syncNonContactInfo(user)
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	jsonResponse(w, status, PortalResponse{true, portal.MXID, created, portal.Key.JID})
+}
+
+type CreateGroupRequest struct {
+	Name         string   `json:"name"`
+	Participants []string `json:"participants"`
+}
+
+func (prov *ProvisioningAPI) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	user := prov.loggedInUser(w, r)
+	if user == nil {
+		return
+	}
+	var req CreateGroupRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Name) == 0 {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Request body must contain a group name",
+			ErrCode: "bad json",
+		})
+		return
+	}
+
+	selfMembers := skype.Members{}
+	selfMembers.Members = append(selfMembers.Members, skype.Member{
+		Id:   strings.Replace(user.JID, skypeExt.NewUserSuffix, "", 1),
+		Role: "Admin",
+	})
+	selfMembers.Properties = skype.Properties{
+		HistoryDisclosed: "true",
+		Topic:            req.Name,
+	}
+	prov.log.Debugln("Create Group", req.Name, "with", selfMembers, req.Participants, "for", user.MXID)
+	conversationId, err := user.createSkypeGroup(selfMembers)
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to create group: %v", err),
+			ErrCode: "group creation failed",
+		})
+		return
+	}
+
+	if len(req.Participants) > 0 {
+		participantMembers := skype.Members{}
+		for _, participant := range req.Participants {
+			participantMembers.Members = append(participantMembers.Members, skype.Member{
+				Id:   strings.Replace(participant, skypeExt.NewUserSuffix, "", 1),
+				Role: "Admin",
+			})
+		}
+		err = user.Conn.AddMember(participantMembers, conversationId)
+		if err != nil {
+			prov.log.Warnfln("Failed to add members to %s: %v", conversationId, err)
+		}
+	}
+
+	portal := prov.bridge.GetPortalByJID(database.GroupPortalKey(conversationId))
+	portal.Name = req.Name
+	err = portal.CreateMatrixRoom(user)
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to create portal room: %v", err),
+			ErrCode: "room creation failed",
+		})
+		return
+	}
+	jsonResponse(w, http.StatusCreated, PortalResponse{true, portal.MXID, true, portal.Key.JID})
+}
+
+type JoinGroupRequest struct {
+	Link string `json:"link"`
+}
+
+func (prov *ProvisioningAPI) JoinGroup(w http.ResponseWriter, r *http.Request) {
+	user := prov.loggedInUser(w, r)
+	if user == nil {
+		return
+	}
+	var req JoinGroupRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Link) == 0 {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Request body must contain an invitation link",
+			ErrCode: "bad json",
+		})
+		return
+	}
+	err, info := user.Conn.HandleGroupJoin(req.Link)
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to join group: %v", err),
+			ErrCode: "join failed",
+		})
+		return
+	}
+	jid := info.Resource
+	if !strings.HasSuffix(jid, skypeExt.GroupSuffix) {
+		jsonResponse(w, http.StatusOK, Response{true, "Joined group"})
+		return
+	}
+	portal := prov.bridge.GetPortalByJID(database.GroupPortalKey(jid))
+	created := len(portal.MXID) == 0
+	err = portal.CreateMatrixRoom(user)
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Joined group, but failed to create portal room: %v", err),
+			ErrCode: "room creation failed",
+		})
+		return
+	}
+	_, _ = portal.MainIntent().InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: user.MXID})
+	jsonResponse(w, http.StatusOK, PortalResponse{true, portal.MXID, created, portal.Key.JID})
+}
+
+func (prov *ProvisioningAPI) Sync(w http.ResponseWriter, r *http.Request) {
+	user := prov.loggedInUser(w, r)
+	if user == nil {
+		return
+	}
+	create := r.URL.Query().Get("create_all") == "true"
+	err := user.Conn.ContactList(user.Conn.UserProfile.Username)
+	if err != nil {
+		user.log.Errorln("Error get contacts:", err)
+	}
+	err = user.Conn.GetConversations("", prov.bridge.Config.Bridge.InitialChatSync)
+	if err != nil {
+		user.log.Errorln("Error get conversations:", err)
+	}
+	syncAll(user, create)
+
+	rooms := make(map[string]id.RoomID)
+	for _, portal := range user.GetPortals() {
+		if len(portal.MXID) > 0 {
+			rooms[portal.Key.JID] = portal.MXID
+		}
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"rooms":   rooms,
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kelaresg/matrix-skype/config"
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestProvisioningAPI(openIDServer string) *ProvisioningAPI {
+	cfg := &config.Config{}
+	cfg.Homeserver.Address = openIDServer
+	cfg.Homeserver.Domain = "example.com"
+	cfg.AppService.Provisioning.SharedSecret = "secret"
+	cfg.AppService.Provisioning.AllowOpenID = true
+	return &ProvisioningAPI{
+		bridge: &Bridge{Config: cfg},
+		log:    log.Sub("Provisioning"),
+	}
+}
+
+func TestProvisioningAPI_VerifyOpenIDToken(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/federation/v1/openid/userinfo" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("access_token") {
+		case "valid":
+			_ = json.NewEncoder(w).Encode(map[string]string{"sub": "@alice:example.com"})
+		case "remote":
+			_ = json.NewEncoder(w).Encode(map[string]string{"sub": "@mallory:evil.com"})
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer stub.Close()
+	prov := newTestProvisioningAPI(stub.URL)
+
+	tests := []struct {
+		name    string
+		token   string
+		want    id.UserID
+		wantErr bool
+	}{
+		{"valid token", "valid", "@alice:example.com", false},
+		{"unknown token", "invalid", "", true},
+		{"user on another server", "remote", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := prov.verifyOpenIDToken(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyOpenIDToken() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("verifyOpenIDToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvisioningAPI_AuthMiddleware(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer stub.Close()
+	prov := newTestProvisioningAPI(stub.URL)
+	handler := prov.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should have been rejected")
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no header", "", http.StatusForbidden},
+		{"short header", "Bear", http.StatusForbidden},
+		{"wrong secret", "Bearer wrong", http.StatusForbidden},
+		{"invalid openid token", "Bearer openid:invalid", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+			if len(tt.header) > 0 {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("AuthMiddleware() status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"time"
+)
+
+const pruneBatchDelay = 100 * time.Millisecond
+
+// StartMessagePruner periodically removes message mappings that are past the configured retention.
+// It runs until StopMessagePruner is called.
+func (bridge *Bridge) StartMessagePruner() {
+	defer close(bridge.prunerStopped)
+	cfg := bridge.Config.Bridge.MessageRetention
+	if cfg.MaxAge <= 0 && cfg.MaxPerPortal <= 0 && cfg.DropContentAfter <= 0 {
+		return
+	}
+	interval := time.Duration(cfg.PruneInterval) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	log := bridge.Log.Sub("Retention")
+	log.Debugln("Pruning message mappings every", interval)
+	for {
+		bridge.pruneMessages()
+		select {
+		case <-bridge.stopPruner:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// StopMessagePruner stops the message pruner, waiting for the batch that's being deleted to finish.
+func (bridge *Bridge) StopMessagePruner() {
+	close(bridge.stopPruner)
+	<-bridge.prunerStopped
+}
+
+// isPrunerStopping checks if StopMessagePruner has been called, so that pruning can stop between batches.
+func (bridge *Bridge) isPrunerStopping() bool {
+	select {
+	case <-bridge.stopPruner:
+		return true
+	default:
+		return false
+	}
+}
+
+func (bridge *Bridge) pruneMessages() {
+	cfg := bridge.Config.Bridge.MessageRetention
+	log := bridge.Log.Sub("Retention")
+	batchSize := cfg.PruneBatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	now := uint64(time.Now().Unix())
+	daysAgo := func(days int) uint64 {
+		age := uint64(days) * 24 * 60 * 60
+		if age > now {
+			return 0
+		}
+		return now - age
+	}
+
+	if cfg.MaxAge > 0 {
+		cutoff := daysAgo(cfg.MaxAge)
+		count, err := pruneInBatches(bridge.stopPruner, batchSize, func() (int64, error) {
+			return bridge.DB.Message.DeleteOlderThan(cutoff, batchSize)
+		})
+		if err != nil {
+			log.Warnln("Failed to delete old messages:", err)
+		} else if count > 0 {
+			log.Infofln("Deleted %d messages older than %d days", count, cfg.MaxAge)
+		}
+	}
+
+	if cfg.MaxPerPortal > 0 && !bridge.isPrunerStopping() {
+		for _, chat := range bridge.DB.Message.GetChatsOverLimit(cfg.MaxPerPortal) {
+			if bridge.isPrunerStopping() {
+				return
+			}
+			count, err := pruneInBatches(bridge.stopPruner, batchSize, func() (int64, error) {
+				return bridge.DB.Message.DeleteExcess(chat, cfg.MaxPerPortal, batchSize)
+			})
+			if err != nil {
+				log.Warnfln("Failed to delete excess messages in %s: %v", chat, err)
+			} else if count > 0 {
+				log.Debugfln("Deleted %d excess messages in %s", count, chat)
+			}
+		}
+	}
+
+	if cfg.DropContentAfter > 0 && !bridge.isPrunerStopping() {
+		cutoff := daysAgo(cfg.DropContentAfter)
+		count, err := pruneInBatches(bridge.stopPruner, batchSize, func() (int64, error) {
+			return bridge.DB.Message.DropContentOlderThan(cutoff, batchSize)
+		})
+		if err != nil {
+			log.Warnln("Failed to drop old message content:", err)
+		} else if count > 0 {
+			log.Infofln("Dropped content of %d messages older than %d days", count, cfg.DropContentAfter)
+		}
+	}
+}
+
+// pruneInBatches calls prune until it affects less than a full batch of rows or stop is closed,
+// pausing between batches so that pruning doesn't hog the database.
+func pruneInBatches(stop <-chan struct{}, batchSize int, prune func() (int64, error)) (total int64, err error) {
+	for {
+		var count int64
+		count, err = prune()
+		total += count
+		if err != nil || count < int64(batchSize) {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(pruneBatchDelay):
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/kelaresg/matrix-skype/database"
+	skypeExt "github.com/kelaresg/matrix-skype/skype-ext"
+)
+
+// Skype favourites are bridged as favourite rooms and hidden conversations as low priority rooms.
+// Tags and push rules are per user, so they can only be bridged for users with double puppeting.
+const (
+	RoomTagFavourite   = "m.favourite"
+	RoomTagLowPriority = "m.lowpriority"
+)
+
+func (user *User) customIntent() *appservice.IntentAPI {
+	puppet := user.bridge.GetPuppetByCustomMXID(user.MXID)
+	if puppet == nil {
+		return nil
+	}
+	return puppet.CustomIntent()
+}
+
+func (user *User) getSkypeTags(key database.PortalKey) (skypeExt.ConversationTags, bool) {
+	user.skypeTagsLock.Lock()
+	defer user.skypeTagsLock.Unlock()
+	tags, ok := user.skypeTags[key]
+	return tags, ok
+}
+
+func (user *User) setSkypeTags(key database.PortalKey, tags skypeExt.ConversationTags) {
+	user.skypeTagsLock.Lock()
+	defer user.skypeTagsLock.Unlock()
+	if user.skypeTags == nil {
+		user.skypeTags = make(map[database.PortalKey]skypeExt.ConversationTags)
+	}
+	user.skypeTags[key] = tags
+}
+
+// SyncSkypeTags copies the favourite, muted and hidden state of the Skype conversation to the room.
+// The room's current tags and push rules are checked first, so unchanged state isn't sent again.
+func (portal *Portal) SyncSkypeTags(user *User, tags skypeExt.ConversationTags) {
+	intent := user.customIntent()
+	if intent == nil || len(portal.MXID) == 0 {
+		return
+	}
+	user.setSkypeTags(portal.Key, tags)
+	portal.setRoomTag(intent, RoomTagFavourite, tags.Favorite)
+	portal.setRoomTag(intent, RoomTagLowPriority, tags.Hidden)
+	portal.setRoomMuted(intent, tags.Muted)
+}
+
+func (portal *Portal) setRoomTag(intent *appservice.IntentAPI, tag string, shouldHave bool) {
+	tags, err := intent.GetTags(portal.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to get room tags of %s: %v", intent.UserID, err)
+		return
+	}
+	_, hasTag := tags.Tags[tag]
+	if shouldHave && !hasTag {
+		err = intent.AddTag(portal.MXID, tag, 0.5)
+	} else if !shouldHave && hasTag {
+		err = intent.RemoveTag(portal.MXID, tag)
+	}
+	if err != nil {
+		portal.log.Warnfln("Failed to update %s tag of %s: %v", tag, intent.UserID, err)
+	}
+}
+
+func (portal *Portal) setRoomMuted(intent *appservice.IntentAPI, muted bool) {
+	rule, err := intent.GetPushRule("global", pushrules.RoomRule, string(portal.MXID))
+	if err == nil && isMuteRule(rule) == muted {
+		return
+	} else if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.IsStatus(404) && !muted {
+		return
+	}
+	if muted {
+		err = intent.PutPushRule("global", pushrules.RoomRule, string(portal.MXID), &mautrix.ReqPutPushRule{
+			Actions: []pushrules.PushActionType{pushrules.ActionDontNotify},
+		})
+	} else {
+		err = intent.DeletePushRule("global", pushrules.RoomRule, string(portal.MXID))
+		if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.IsStatus(404) {
+			err = nil
+		}
+	}
+	if err != nil {
+		portal.log.Warnfln("Failed to update mute push rule of %s: %v", intent.UserID, err)
+	}
+}
+
+func isMuteRule(rule *pushrules.PushRule) bool {
+	if rule == nil || !rule.Enabled {
+		return false
+	}
+	for _, action := range rule.Actions {
+		if action.Action == pushrules.ActionDontNotify {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRoomTagEvent writes favourite and low priority changes made on Matrix back to Skype.
+func (puppet *Puppet) handleRoomTagEvent(portal *Portal, evt *event.Event) {
+	user := puppet.customUser
+	content, ok := evt.Content.Parsed.(*event.TagEventContent)
+	if !ok || user.Conn == nil || !user.Conn.LoggedIn {
+		return
+	}
+	tags, ok := user.getSkypeTags(portal.Key)
+	if !ok {
+		// The Skype state hasn't been fetched yet, so there's nothing to compare against
+		return
+	}
+	_, favorite := content.Tags[RoomTagFavourite]
+	_, hidden := content.Tags[RoomTagLowPriority]
+	if favorite != tags.Favorite {
+		err := user.Conn.SetConversationProperty(portal.Key.JID, skypeExt.ConversationPropertyFavorite, favorite)
+		if err != nil {
+			portal.log.Warnln("Failed to bridge favourite tag to Skype:", err)
+		} else {
+			tags.Favorite = favorite
+		}
+	}
+	if hidden != tags.Hidden {
+		err := user.Conn.SetConversationProperty(portal.Key.JID, skypeExt.ConversationPropertyHidden, hidden)
+		if err != nil {
+			portal.log.Warnln("Failed to bridge low priority tag to Skype:", err)
+		} else {
+			tags.Hidden = hidden
+		}
+	}
+	user.setSkypeTags(portal.Key, tags)
+}
+
+// handlePushRulesEvent writes room mutes made on Matrix back to Skype.
+func (puppet *Puppet) handlePushRulesEvent(evt *event.Event) {
+	user := puppet.customUser
+	if user.Conn == nil || !user.Conn.LoggedIn {
+		return
+	}
+	ruleset, err := pushrules.EventToPushRules(evt)
+	if err != nil {
+		puppet.log.Warnln("Failed to parse push rules:", err)
+		return
+	}
+	for _, key := range user.GetPortalKeys() {
+		tags, ok := user.getSkypeTags(key)
+		if !ok {
+			continue
+		}
+		portal := user.bridge.GetPortalByJID(key)
+		if portal == nil || len(portal.MXID) == 0 {
+			continue
+		}
+		muted := isMuteRule(ruleset.Room.Map[string(portal.MXID)])
+		if muted == tags.Muted {
+			continue
+		}
+		err = user.Conn.SetConversationProperty(portal.Key.JID, skypeExt.ConversationPropertyAlerts, !muted)
+		if err != nil {
+			portal.log.Warnln("Failed to bridge mute to Skype:", err)
+			continue
+		}
+		tags.Muted = muted
+		user.setSkypeTags(key, tags)
+	}
+}
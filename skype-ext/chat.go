@@ -18,6 +18,7 @@ package skypeExt
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	skype "github.com/kelaresg/go-skypeapi"
 	"strings"
 )
@@ -56,8 +57,31 @@ const (
 	ChatPictureUpdate ChatActionType = "ThreadActivity/PictureUpdate"
 	ChatMemberAdd     ChatActionType = "ThreadActivity/AddMember"
 	ChatMemberDelete  ChatActionType = "ThreadActivity/DeleteMember"
+
+	ChatRoleUpdate             ChatActionType = "ThreadActivity/RoleUpdate"
+	ChatHistoryDisclosedUpdate ChatActionType = "ThreadActivity/HistoryDisclosedUpdate"
+	ChatJoiningEnabledUpdate   ChatActionType = "ThreadActivity/JoiningEnabledUpdate"
+	ChatPinnedMessage          ChatActionType = "ThreadActivity/PinnedMessage"
 )
 
+type ChatRoleUpdateContent struct {
+	XMLName   xml.Name `xml:"roleupdate"`
+	EventTime string   `xml:"eventtime"`
+	Initiator string   `xml:"initiator"`
+	Targets   []struct {
+		Id   string `xml:"id"`
+		Role string `xml:"role"`
+	} `xml:"target"`
+}
+
+// ChatPropertyUpdateContent is the content of the ThreadActivity events that change a single thread property,
+// e.g. <historydisclosedupdate> or <joiningenabledupdate>.
+type ChatPropertyUpdateContent struct {
+	EventTime string `xml:"eventtime"`
+	Initiator string `xml:"initiator"`
+	Value     string `xml:"value"`
+}
+
 type ChatUpdateData struct {
 	Action    ChatActionType
 	SenderJID string
@@ -0,0 +1,78 @@
+// matrix-skype - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package skypeExt
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/kelaresg/go-skypeapi"
+)
+
+type ContactInvite struct {
+	Mri         string `json:"mri"`
+	DisplayName string `json:"displayname"`
+	Invites     []struct {
+		Message string `json:"message"`
+		Time    string `json:"time"`
+	} `json:"invites"`
+}
+
+type contactInviteList struct {
+	InviteList []ContactInvite `json:"invite_list"`
+}
+
+// contactsRequest sends a request to the contacts API of the logged in user.
+func (ext *ExtendedConn) contactsRequest(method, path string, body interface{}, resp interface{}) error {
+	reqURL := fmt.Sprintf("%s/users/%s%s", skype.API_CONTACTS, url.PathEscape(ext.Conn.UserProfile.Username), path)
+	return apiRequest(method, reqURL, map[string]string{
+		"X-Skypetoken": ext.Conn.LoginInfo.SkypeToken,
+	}, body, resp)
+}
+
+// SendContactRequest asks the user with the given MRI (8:live:xxx) to become a contact.
+func (ext *ExtendedConn) SendContactRequest(mri, greeting string) error {
+	return ext.contactsRequest(http.MethodPost, "/contacts", map[string]interface{}{
+		"mri":         mri,
+		"greeting":    greeting,
+		"send_invite": true,
+	}, nil)
+}
+
+// RemoveContact removes the user with the given MRI from the contact list.
+func (ext *ExtendedConn) RemoveContact(mri string) error {
+	return ext.contactsRequest(http.MethodDelete, "/contacts/"+url.PathEscape(mri), nil, nil)
+}
+
+// GetContactInvites returns the pending incoming contact requests.
+func (ext *ExtendedConn) GetContactInvites() ([]ContactInvite, error) {
+	var list contactInviteList
+	err := ext.contactsRequest(http.MethodGet, "/invites", nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list.InviteList, nil
+}
+
+func (ext *ExtendedConn) AcceptContactInvite(mri string) error {
+	return ext.contactsRequest(http.MethodPut, "/invites/"+url.PathEscape(mri)+"/accept", nil, nil)
+}
+
+func (ext *ExtendedConn) DeclineContactInvite(mri string) error {
+	return ext.contactsRequest(http.MethodPut, "/invites/"+url.PathEscape(mri)+"/decline", nil, nil)
+}
@@ -0,0 +1,138 @@
+// matrix-skype - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package skypeExt
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/kelaresg/go-skypeapi"
+)
+
+// Names of the per-user conversation properties that are bridged as room tags.
+const (
+	ConversationPropertyFavorite = "favorite"
+	ConversationPropertyAlerts   = "alerts"
+	ConversationPropertyHidden   = "hidden"
+)
+
+type ConversationTags struct {
+	Favorite bool
+	Muted    bool
+	Hidden   bool
+}
+
+func (ext *ExtendedConn) messengerHeaders() map[string]string {
+	return map[string]string{
+		"Authentication":    "skypetoken=" + ext.Conn.LoginInfo.SkypeToken,
+		"RegistrationToken": ext.Conn.LoginInfo.RegistrationTokenStr,
+		"BehaviorOverride":  "redirectAs404",
+	}
+}
+
+// messengerRequest sends a request to the messaging API of the logged in user.
+func (ext *ExtendedConn) messengerRequest(method, path string, body interface{}, resp interface{}) error {
+	return apiRequest(method, ext.Conn.LoginInfo.LocationHost+path, ext.messengerHeaders(), body, resp)
+}
+
+// CreateGroup creates a group conversation and returns its ID, which Skype only reports in the Location header.
+// The ID is empty if the response didn't include it.
+func (ext *ExtendedConn) CreateGroup(members skype.Members) (string, error) {
+	res, err := rawAPIRequest(http.MethodPost, ext.Conn.LoginInfo.LocationHost+"/v1/threads", ext.messengerHeaders(), members)
+	if err != nil {
+		return "", fmt.Errorf("failed to create group: %v", err)
+	}
+	_ = res.Body.Close()
+	location := res.Header.Get("Location")
+	index := strings.LastIndex(location, "/threads/")
+	if index < 0 {
+		return "", nil
+	}
+	conversationID, err := url.PathUnescape(location[index+len("/threads/"):])
+	if err != nil {
+		return "", nil
+	}
+	return conversationID, nil
+}
+
+// DeleteMessage deletes a message sent by the logged in user. Unlike skype.Conn.DeleteMessage, it reports failures.
+func (ext *ExtendedConn) DeleteMessage(conversationID, messageID string) error {
+	path := fmt.Sprintf("/v1/users/ME/conversations/%s/messages/%s", url.PathEscape(conversationID), url.PathEscape(messageID))
+	err := ext.messengerRequest(http.MethodDelete, path, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %v", err)
+	}
+	return nil
+}
+
+// GetAllConversationTags fetches whether each conversation is favorited, muted or hidden.
+// The library's conversation list doesn't keep these properties, so the list is fetched again,
+// but the tags of all conversations are read from the same pages instead of one request per conversation.
+func (ext *ExtendedConn) GetAllConversationTags() (map[string]ConversationTags, error) {
+	link := fmt.Sprintf("%s/v1/users/ME/conversations?startTime=0&view=msnp24Equivalent&targetType=Passport|Skype|Lync|Thread&pageSize=100", ext.Conn.LoginInfo.LocationHost)
+	tags := make(map[string]ConversationTags)
+	for len(link) > 0 {
+		var page struct {
+			Conversations []struct {
+				Id         string                 `json:"id"`
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"conversations"`
+			Metadata struct {
+				BackwardLink string `json:"backwardLink"`
+			} `json:"_metadata"`
+		}
+		err := apiRequest(http.MethodGet, link, ext.messengerHeaders(), nil, &page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get conversation properties: %v", err)
+		}
+		for _, conv := range page.Conversations {
+			tags[conv.Id] = parseConversationTags(conv.Properties)
+		}
+		link = page.Metadata.BackwardLink
+	}
+	return tags, nil
+}
+
+func parseConversationTags(properties map[string]interface{}) ConversationTags {
+	isTrue := func(name string) bool {
+		switch value := properties[name].(type) {
+		case bool:
+			return value
+		case string:
+			parsed, _ := strconv.ParseBool(value)
+			return parsed
+		}
+		return false
+	}
+	_, hasAlerts := properties[ConversationPropertyAlerts]
+	return ConversationTags{
+		Favorite: isTrue(ConversationPropertyFavorite),
+		Muted:    hasAlerts && !isTrue(ConversationPropertyAlerts),
+		Hidden:   isTrue(ConversationPropertyHidden),
+	}
+}
+
+// SetConversationProperty changes a per-user property of the conversation, e.g. ConversationPropertyFavorite.
+func (ext *ExtendedConn) SetConversationProperty(conversationID, name string, value bool) error {
+	path := fmt.Sprintf("/v1/users/ME/conversations/%s/properties?name=%s", url.PathEscape(conversationID), url.QueryEscape(name))
+	return ext.messengerRequest(http.MethodPut, path, map[string]string{
+		name: strconv.FormatBool(value),
+	}, nil)
+}
@@ -0,0 +1,72 @@
+// matrix-skype - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2019 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package skypeExt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var apiClient = &http.Client{Timeout: 30 * time.Second}
+
+// apiRequest sends a JSON request to the Skype API and decodes the response into resp if it's not nil.
+// Unlike the request helpers of go-skypeapi, it fails on error status codes.
+func apiRequest(method, reqURL string, headers map[string]string, body interface{}, resp interface{}) error {
+	res, err := rawAPIRequest(method, reqURL, headers, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if resp != nil {
+		return json.NewDecoder(res.Body).Decode(resp)
+	}
+	return nil
+}
+
+// rawAPIRequest sends a JSON request to the Skype API and returns the response for callers that need its headers.
+// The caller must close the response body.
+func rawAPIRequest(method, reqURL string, headers map[string]string, body interface{}) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, reqURL, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return res, nil
+}
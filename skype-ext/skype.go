@@ -23,6 +23,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -92,6 +93,8 @@ type GroupInfo struct {
 	TopicSetAt int64  `json:"descTime"`
 	TopicSetBy string `json:"descOwner"`
 
+	Description string `json:"description"`
+
 	GroupCreated int64 `json:"creation"`
 
 	Status int16 `json:"status"`
@@ -150,6 +153,13 @@ func (ext *ExtendedConn) GetGroupMetaData(jid string) (*GroupInfo, error) {
 	}
 	info.Topic = data.ThreadProperties.Topic
 	info.Name = data.ThreadProperties.Topic
+	// The description lives in the thread properties; groups are still usable without it
+	thread, err := ext.GetThreadInfo(jid)
+	if err == nil {
+		info.Description = thread.Properties.Description
+	} else {
+		fmt.Println("GetGroupMetaData: failed to get thread properties:", err)
+	}
 	fmt.Println()
 	fmt.Println("GetGroupMetaData:3 ")
 	fmt.Println()
@@ -159,6 +169,41 @@ func (ext *ExtendedConn) GetGroupMetaData(jid string) (*GroupInfo, error) {
 	return info, nil
 }
 
+type ThreadInfo struct {
+	Id         string `json:"id"`
+	Properties struct {
+		Topic            string `json:"topic"`
+		Description      string `json:"description"`
+		Picture          string `json:"picture"`
+		HistoryDisclosed string `json:"historydisclosed"` // true|false
+		JoiningEnabled   string `json:"joiningenabled"`   // true|false
+	} `json:"properties"`
+	Members []skype.Member `json:"members"`
+}
+
+// GetThreadInfo fetches the properties and member roles of a group thread.
+func (ext *ExtendedConn) GetThreadInfo(jid string) (*ThreadInfo, error) {
+	path := fmt.Sprintf("%s/v1/threads/%s", ext.Conn.LoginInfo.LocationHost, url.PathEscape(jid))
+	headers := map[string]string{
+		"Authentication":    "skypetoken=" + ext.Conn.LoginInfo.SkypeToken,
+		"RegistrationToken": ext.Conn.LoginInfo.RegistrationTokenStr,
+		"BehaviorOverride":  "redirectAs404",
+	}
+	params := url.Values{}
+	params.Set("view", "msnp24Equivalent")
+	req := skype.Request{}
+	body, err := req.HttpGetWitHeaderAndCookiesJson(path, params, "", nil, headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread info: %v", err)
+	}
+	info := &ThreadInfo{}
+	err = json.Unmarshal([]byte(body), info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal thread info: %v", err)
+	}
+	return info, nil
+}
+
 type ProfilePicInfo struct {
 	URL string `json:"eurl"`
 	Tag string `json:"tag"`
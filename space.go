@@ -0,0 +1,119 @@
+package main
+
+import (
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var (
+	StateSpaceChild  = event.Type{Type: "m.space.child", Class: event.StateEventType}
+	StateSpaceParent = event.Type{Type: "m.space.parent", Class: event.StateEventType}
+)
+
+type SpaceChildEventContent struct {
+	Via []string `json:"via,omitempty"`
+}
+
+type SpaceParentEventContent struct {
+	Via       []string `json:"via,omitempty"`
+	Canonical bool     `json:"canonical,omitempty"`
+}
+
+// GetSpaceRoom returns the personal filtering space of the user, creating it if it doesn't exist yet.
+func (user *User) GetSpaceRoom() id.RoomID {
+	if user.IsRelaybot || !user.bridge.Config.Bridge.PersonalFilteringSpaces {
+		return ""
+	}
+	user.spaceCreateLock.Lock()
+	defer user.spaceCreateLock.Unlock()
+	if len(user.SpaceRoom) > 0 {
+		return user.SpaceRoom
+	}
+
+	initialState := []*event.Event{}
+	avatar, err := id.ParseContentURI(user.bridge.Config.AppService.Bot.Avatar)
+	if err == nil && !avatar.IsEmpty() {
+		initialState = append(initialState, &event.Event{
+			Type: event.StateRoomAvatar,
+			Content: event.Content{
+				Parsed: event.RoomAvatarEventContent{URL: avatar},
+			},
+		})
+	}
+	user.log.Debugln("Creating personal filtering space")
+	resp, err := user.bridge.Bot.CreateRoom(&mautrix.ReqCreateRoom{
+		Visibility: "private",
+		Name:       "Skype",
+		Topic:      "Your Skype bridged chats",
+		Invite:     []id.UserID{user.MXID},
+		CreationContent: map[string]interface{}{
+			"type": "m.space",
+		},
+		InitialState: initialState,
+	})
+	if err != nil {
+		user.log.Warnln("Failed to create personal filtering space:", err)
+		return ""
+	}
+	user.log.Infoln("Created personal filtering space", resp.RoomID)
+	user.SpaceRoom = resp.RoomID
+	user.Update()
+	customPuppet := user.bridge.GetPuppetByCustomMXID(user.MXID)
+	if customPuppet != nil && customPuppet.CustomIntent() != nil {
+		_ = customPuppet.CustomIntent().EnsureJoined(user.SpaceRoom)
+	}
+	return user.SpaceRoom
+}
+
+// addPortalToSpace adds the portal room to the personal filtering space of the user
+// and points the portal back to the space.
+func (user *User) addPortalToSpace(portal *Portal) bool {
+	if len(portal.MXID) == 0 {
+		return false
+	}
+	spaceRoom := user.GetSpaceRoom()
+	if len(spaceRoom) == 0 {
+		return false
+	}
+	via := []string{user.bridge.Config.Homeserver.Domain}
+	_, err := user.bridge.Bot.SendStateEvent(spaceRoom, StateSpaceChild, portal.MXID.String(), &SpaceChildEventContent{Via: via})
+	if err != nil {
+		user.log.Warnfln("Failed to add %s to %s: %v", portal.MXID, spaceRoom, err)
+		return false
+	}
+	_, err = portal.MainIntent().SendStateEvent(portal.MXID, StateSpaceParent, spaceRoom.String(), &SpaceParentEventContent{Via: via})
+	if err != nil {
+		portal.log.Warnfln("Failed to set %s as parent space: %v", spaceRoom, err)
+	}
+	user.log.Debugln("Added", portal.MXID, "to", spaceRoom)
+	return true
+}
+
+// removePortalFromSpace removes the given portal room from the personal filtering space of the user.
+func (user *User) removePortalFromSpace(portal *Portal, roomID id.RoomID) {
+	if len(user.SpaceRoom) == 0 || len(roomID) == 0 {
+		return
+	}
+	_, err := user.bridge.Bot.SendStateEvent(user.SpaceRoom, StateSpaceChild, roomID.String(), struct{}{})
+	if err != nil {
+		user.log.Warnfln("Failed to remove %s from %s: %v", roomID, user.SpaceRoom, err)
+	}
+	_, err = portal.MainIntent().SendStateEvent(roomID, StateSpaceParent, user.SpaceRoom.String(), struct{}{})
+	if err != nil {
+		portal.log.Debugfln("Failed to remove parent space %s: %v", user.SpaceRoom, err)
+	}
+}
+
+// removeFromSpaces removes the current Matrix room of the portal from the spaces of all its users.
+func (portal *Portal) removeFromSpaces() {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	for _, userID := range portal.GetUserIDs() {
+		user := portal.bridge.GetUserByMXID(userID)
+		if user != nil {
+			user.removePortalFromSpace(portal, portal.MXID)
+		}
+	}
+}
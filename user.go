@@ -14,6 +14,7 @@ import (
 	//"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "maunium.net/go/maulogger/v2"
@@ -23,6 +24,7 @@ import (
 	//waProto "github.com/Rhymen/go-whatsapp/binary/proto"
 
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/kelaresg/matrix-skype/database"
@@ -44,7 +46,6 @@ type User struct {
 	IsRelaybot bool
 
 	ConnectionErrors int
-	CommunityID      string
 
 	cleanDisconnection bool
 
@@ -54,10 +55,22 @@ type User struct {
 	messages chan PortalMessage
 	syncLock sync.Mutex
 
-	mgmtCreateLock sync.Mutex
+	mgmtCreateLock  sync.Mutex
+	spaceCreateLock sync.Mutex
 
 	contactsPresence map[string]*skypeExt.Presence
 	currentCreateRoomName string
+
+	contactRequestsLoopRunning int32
+
+	// Users found by the last directory search, used by pm <number>. They aren't necessarily contacts.
+	searchResults []skype.Contact
+
+	skypeTags     map[database.PortalKey]skypeExt.ConversationTags
+	skypeTagsLock sync.Mutex
+
+	commandState     *CommandState
+	commandStateLock sync.Mutex
 }
 
 func (bridge *Bridge) GetUserByMXID(userID id.UserID) *User {
@@ -116,7 +129,9 @@ func (bridge *Bridge) GetAllUsers() []*User {
 		if !ok {
 			user = bridge.loadDBUser(dbUser, nil)
 		}
-		user.contactsPresence = make(map[string]*skypeExt.Presence)
+		if user.contactsPresence == nil {
+			user.contactsPresence = make(map[string]*skypeExt.Presence)
+		}
 		output[index] = user
 	}
 	return output
@@ -400,6 +415,7 @@ func (user *User) Login(ce *CommandEvent, name string, password string) (err err
 	}
 	go user.Conn.Poll()
 	go user.monitorSession(ce)
+	go user.loopContactRequests()
 
 	user.ConnectionErrors = 0
 	user.JID = "8:" + user.Conn.UserProfile.Username + skypeExt.NewUserSuffix
@@ -426,12 +442,12 @@ func (user *User) monitorSession(ce *CommandEvent) {
 				user.log.Debugln("Unable to relogin user %s", ce.User.Conn.LoginInfo.Username)
 				ce.Reply("Session expired and relogin failed.")
 				close(user.Conn.Refresh)
-				leavePortals(ce)
+				leavePortals(user)
 			}
 		} else {
 			ce.Reply("Session expired\nStore your password into database with command `save-password` to resolve this issue.")
 			close(user.Conn.Refresh)
-			leavePortals(ce)
+			leavePortals(user)
 		}
 	}
 
@@ -442,6 +458,47 @@ func (user *User) monitorSession(ce *CommandEvent) {
 	fmt.Println("monitorSession1", item, ok)
 }
 
+// Logout forgets the Skype session of the user, keeping the stored credentials,
+// and removes the user from their portals.
+func (user *User) Logout() {
+	user.Conn.LoggedIn = false
+	username := ""
+	password := ""
+	if user.Conn.LoginInfo != nil {
+		username = user.Conn.LoginInfo.Username
+		password = user.Conn.LoginInfo.Password
+	}
+	user.Conn.LoginInfo = &skype.Session{
+		SkypeToken:           "",
+		SkypeExpires:         "",
+		RegistrationToken:    "",
+		RegistrationTokenStr: "",
+		RegistrationExpires:  "",
+		LocationHost:         "",
+		EndpointId:           "",
+		Username:             username,
+		Password:             password,
+	}
+
+	user.Conn.Store = &skype.Store{
+		Contacts: make(map[string]skype.Contact),
+		Chats:    make(map[string]skype.Conversation),
+	}
+	puppet := user.bridge.GetPuppetByJID(user.JID)
+	if puppet.CustomMXID != "" {
+		err := puppet.SwitchCustomMXID("", "")
+		if err != nil {
+			user.log.Warnln("Failed to logout-matrix while logging out of Skype:", err)
+		}
+	}
+	user.Conn.LoginInfo = nil
+	if user.Conn.Refresh != nil {
+		user.Conn.Refresh <- -1
+	} else {
+		leavePortals(user)
+	}
+}
+
 func loopPresence(user *User) {
 	for {
 		for cid, contact := range user.contactsPresence {
@@ -452,6 +509,66 @@ func loopPresence(user *User) {
 	}
 }
 
+// formatContactInvite formats a pending contact request as a markdown list item.
+func formatContactInvite(invite skypeExt.ContactInvite) string {
+	line := fmt.Sprintf("* %s (`%s`)", invite.DisplayName, invite.Mri)
+	if len(invite.Invites) > 0 && len(invite.Invites[0].Message) > 0 {
+		line += ": " + invite.Invites[0].Message
+	}
+	return line
+}
+
+// loopContactRequests periodically checks for new incoming contact requests and
+// sends a notice about each of them to the management room until the user logs out.
+func (user *User) loopContactRequests() {
+	if !atomic.CompareAndSwapInt32(&user.contactRequestsLoopRunning, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&user.contactRequestsLoopRunning, 0)
+	for {
+		if user.Conn == nil || user.Conn.LoginInfo == nil {
+			return
+		}
+		invites, err := user.Conn.GetContactInvites()
+		if err != nil {
+			user.log.Debugln("Failed to get contact requests:", err)
+		}
+		for _, invite := range invites {
+			inviteTime := latestInviteTime(invite)
+			if user.IsContactRequestAnnounced(invite.Mri, inviteTime) {
+				continue
+			}
+			roomID := user.GetManagementRoom()
+			if len(roomID) == 0 {
+				continue
+			}
+			msg := format.RenderMarkdown(fmt.Sprintf("New contact request:\n\n%s\n\nUse `accept %s` or `decline %s` to answer it.",
+				formatContactInvite(invite), invite.Mri, invite.Mri), true, false)
+			msg.MsgType = event.MsgNotice
+			_, err = user.bridge.Bot.SendMessageEvent(roomID, event.EventMessage, msg)
+			if err != nil {
+				// Not marking the request makes the next iteration try again
+				user.log.Warnln("Failed to send contact request notice:", err)
+			} else {
+				user.MarkContactRequestAnnounced(invite.Mri, inviteTime)
+			}
+		}
+		time.Sleep(5 * time.Minute)
+	}
+}
+
+// latestInviteTime returns the time of the newest message in a contact request,
+// which tells apart a request that was sent again from one that was already announced.
+func latestInviteTime(invite skypeExt.ContactInvite) string {
+	var latest string
+	for _, message := range invite.Invites {
+		if message.Time > latest {
+			latest = message.Time
+		}
+	}
+	return latest
+}
+
 type Chat struct {
 	Portal          *Portal
 	LastMessageTime uint64
@@ -489,12 +606,16 @@ func (user *User) tryAutomaticDoublePuppeting() {
 		// Custom puppet already enabled
 		return
 	}
-	accessToken, err := puppet.loginWithSharedSecret(user.MXID)
-	if err != nil {
-		user.log.Warnln("Failed to login with shared secret:", err)
-		return
+	var accessToken string
+	if _, appserviceMode := user.bridge.Config.GetDoublePuppetASToken(user.MXID); !appserviceMode {
+		var err error
+		accessToken, err = puppet.loginWithSharedSecret(user.MXID)
+		if err != nil {
+			user.log.Warnln("Failed to login with shared secret:", err)
+			return
+		}
 	}
-	err = puppet.SwitchCustomMXID(accessToken, user.MXID)
+	err := puppet.SwitchCustomMXID(accessToken, user.MXID)
 	if err != nil {
 		puppet.log.Warnln("Failed to switch to auto-logined custom puppet:", err)
 		return
@@ -505,6 +626,8 @@ func (user *User) tryAutomaticDoublePuppeting() {
 func (user *User) UpdateAccessToken(puppet *Puppet) (err error, accessToken string) {
 	if !puppet.bridge.Config.CanAutoDoublePuppet(user.MXID) {
 		return errors.New("you didn't set LoginSharedSecret or user is on another homeServer"), ""
+	} else if _, appserviceMode := puppet.bridge.Config.GetDoublePuppetASToken(user.MXID); appserviceMode {
+		return errors.New("double puppeting uses the appservice token, so there's no access token to update"), ""
 	}
 	accessToken, err = puppet.loginWithSharedSecret(user.MXID)
 	if err != nil {
@@ -522,7 +645,7 @@ func (user *User) UpdateAccessToken(puppet *Puppet) (err error, accessToken stri
 
 func (user *User) intPostLogin() {
 	defer user.syncLock.Unlock()
-	user.createCommunity()
+	user.GetSpaceRoom()
 	user.tryAutomaticDoublePuppeting()
 
 	select {
@@ -546,7 +669,7 @@ func (user *User) syncPortals(chatMap map[string]skype.Conversation, createAll b
 	}
 	user.log.Infoln("Reading chat list")
 	chats := make(ChatList, 0, len(chatMap))
-	existingKeys := user.GetInCommunityMap()
+	existingKeys := user.GetInSpaceMap()
 	portalKeys := make([]database.PortalKeyWithMeta, 0, len(chatMap))
 	for _, chat := range chatMap {
 		t, err := time.Parse(time.RFC3339, chat.LastMessage.ComposeTime)
@@ -581,15 +704,11 @@ func (user *User) syncPortals(chatMap map[string]skype.Conversation, createAll b
 			Contact:         user.Conn.Store.Chats[cid],
 			LastMessageTime: ts,
 		})
-		var inCommunity, ok bool
-		if inCommunity, ok = existingKeys[portal.Key]; !ok || !inCommunity {
-			inCommunity = user.addPortalToCommunity(portal)
-			if portal.IsPrivateChat() {
-				puppet := user.bridge.GetPuppetByJID(portal.Key.JID + skypeExt.NewUserSuffix)
-				user.addPuppetToCommunity(puppet)
-			}
+		var inSpace, ok bool
+		if inSpace, ok = existingKeys[portal.Key]; !ok || !inSpace {
+			inSpace = user.addPortalToSpace(portal)
 		}
-		portalKeys = append(portalKeys, database.PortalKeyWithMeta{PortalKey: portal.Key, InCommunity: inCommunity})
+		portalKeys = append(portalKeys, database.PortalKeyWithMeta{PortalKey: portal.Key, InSpace: inSpace})
 	}
 	user.log.Infoln("Read chat list, updating user-portal mapping")
 	err := user.SetPortalKeys(portalKeys)
@@ -601,6 +720,13 @@ func (user *User) syncPortals(chatMap map[string]skype.Conversation, createAll b
 	if limit < 0 {
 		limit = len(chats)
 	}
+	var skypeTags map[string]skypeExt.ConversationTags
+	if user.customIntent() != nil {
+		skypeTags, err = user.Conn.GetAllConversationTags()
+		if err != nil {
+			user.log.Warnln("Failed to get conversation tags:", err)
+		}
+	}
 	now := uint64(time.Now().Unix())
 	user.log.Infoln("Syncing portals")
 	for i, chat := range chats {
@@ -610,6 +736,9 @@ func (user *User) syncPortals(chatMap map[string]skype.Conversation, createAll b
 		create := (chat.LastMessageTime >= user.LastConnection && user.LastConnection > 0) || i < limit
 		if len(chat.Portal.MXID) > 0 || create || createAll {
 			chat.Portal.SyncSkype(user, chat.Contact)
+			if tags, ok := skypeTags[chat.Portal.Key.JID]; ok {
+				chat.Portal.SyncSkypeTags(user, tags)
+			}
 			//err := chat.Portal.BackfillHistory(user, chat.LastMessageTime)
 			if err != nil {
 				chat.Portal.log.Errorln("Error backfilling history:", err)
@@ -858,6 +987,142 @@ func (user *User) HandleCommand(cmd skypeExt.Command) {
 	}
 }
 
+// normalizeContactID turns a Skype contact ID like live:xxx or 8:live:xxx@s.skype.net into the 8:live:xxx form.
+func normalizeContactID(contactID string) string {
+	contactID = strings.TrimSuffix(contactID, skypeExt.NewUserSuffix)
+	if !strings.HasPrefix(contactID, "8:") {
+		contactID = "8:" + contactID
+	}
+	return contactID
+}
+
+// BlockContact blocks the given Skype contact for the user.
+func (user *User) BlockContact(contactID string) error {
+	if user.Conn == nil || !user.Conn.LoggedIn {
+		return errors.New("not logged into Skype")
+	}
+	user.log.Debugln("Blocking contact", contactID)
+	err, _ := user.Conn.BlockContact(user.Conn.LoginInfo.SkypeToken, user.Conn.UserProfile.Username, normalizeContactID(contactID), false, false)
+	return err
+}
+
+// UnblockContact unblocks the given Skype contact for the user.
+func (user *User) UnblockContact(contactID string) error {
+	if user.Conn == nil || !user.Conn.LoggedIn {
+		return errors.New("not logged into Skype")
+	}
+	user.log.Debugln("Unblocking contact", contactID)
+	err, _ := user.Conn.UnBlockContact(user.Conn.LoginInfo.SkypeToken, user.Conn.UserProfile.Username, normalizeContactID(contactID))
+	return err
+}
+
+// createSkypeGroup creates a Skype group with the given members and returns its conversation ID.
+//
+// The ID is normally taken from the create response. If Skype doesn't include it there, this falls back to
+// waiting for the group creation event, which can also be caused by groups created elsewhere, so the
+// topic of the reported group is checked against the requested one.
+func (user *User) createSkypeGroup(members skype.Members) (string, error) {
+	// Throw away any group creation event received earlier, so it can't be mistaken for this group.
+	// CreateChan itself is replaced by the Skype connection for every created group, so it's only read here.
+	select {
+	case <-user.Conn.CreateChan:
+	default:
+	}
+	conversationID, err := user.Conn.CreateGroup(members)
+	if err != nil {
+		return "", err
+	} else if len(conversationID) > 0 {
+		return conversationID, nil
+	}
+	user.log.Debugln("Group create response didn't contain the conversation ID, waiting for the creation event")
+	timeout := time.After(time.Duration(user.bridge.Config.Bridge.ConnectionTimeout) * time.Second)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeout:
+			return "", errors.New("timed out waiting for Skype to create the group")
+		case <-ticker.C:
+			select {
+			case conversationID, ok := <-user.Conn.CreateChan:
+				if !ok || len(conversationID) == 0 {
+					continue
+				}
+				conv, err := user.Conn.GetConversation(conversationID)
+				if err != nil || conv.ThreadProperties.Topic != members.Properties.Topic {
+					user.log.Debugfln("Ignoring creation event of %s: it doesn't look like the requested group", conversationID)
+					continue
+				}
+				return conversationID, nil
+			default:
+			}
+		}
+	}
+}
+
+// createGroupForRoom creates a Skype group with the given participants and binds the Matrix room to it as its portal.
+func (user *User) createGroupForRoom(roomID id.RoomID, name string, participants []types.SkypeID, encrypted bool) (*Portal, error) {
+	selfMembers := skype.Members{}
+	selfMembers.Members = append(selfMembers.Members, skype.Member{
+		Id:   strings.Replace(user.JID, skypeExt.NewUserSuffix, "", 1),
+		Role: "Admin",
+	})
+	selfMembers.Properties = skype.Properties{
+		HistoryDisclosed: "true",
+		Topic:            name,
+	}
+	user.currentCreateRoomName = name
+	defer func() {
+		user.currentCreateRoomName = ""
+	}()
+	user.log.Debugln("Create Group", name, "with", selfMembers, participants, "for", roomID)
+	conversationID, err := user.createSkypeGroup(selfMembers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+	user.log.Debugln("Create Group: conversationId=", conversationID)
+
+	portal := user.bridge.GetPortalByJID(database.GroupPortalKey(conversationID))
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	if len(portal.MXID) != 0 {
+		portal.log.Warnln("Detected race condition in room creation")
+		// TODO race condition, clean up the old room
+	}
+	portal.MXID = roomID
+	portal.Name = name
+	portal.Encrypted = encrypted
+	if !portal.Encrypted && user.bridge.Config.Bridge.Encryption.Default {
+		_, err = portal.MainIntent().SendStateEvent(portal.MXID, event.StateEncryption, "", &event.EncryptionEventContent{Algorithm: id.AlgorithmMegolmV1})
+		if err != nil {
+			portal.log.Warnln("Failed to enable e2be:", err)
+		}
+		portal.Encrypted = true
+	}
+	portal.Update()
+	user.bridge.portalsLock.Lock()
+	user.bridge.portalsByMXID[portal.MXID] = portal
+	user.bridge.portalsLock.Unlock()
+	portal.UpdateBridgeInfo()
+
+	if len(participants) > 0 {
+		participantMembers := skype.Members{}
+		for _, participant := range participants {
+			participantMembers.Members = append(participantMembers.Members, skype.Member{
+				Id:   strings.Replace(participant, skypeExt.NewUserSuffix, "", 1),
+				Role: "Admin",
+			})
+		}
+		err = user.Conn.AddMember(participantMembers, conversationID)
+		if err != nil {
+			portal.log.Warnfln("Failed to add members to %s: %v", conversationID, err)
+		}
+	}
+	inSpace := user.addPortalToSpace(portal)
+	user.CreateUserPortal(database.PortalKeyWithMeta{PortalKey: portal.Key, InSpace: inSpace})
+	return portal, nil
+}
+
 func (user *User) HandleChatUpdate(cmd skype.Resource) {
 	user.log.Debugfln("HandleChatUpdate: jid=%s, user.jid=%s", cmd.Jid, user.JID)
 
@@ -897,7 +1162,17 @@ func (user *User) HandleChatUpdate(cmd skype.Resource) {
 			portalName = cmd.ThreadTopic
 		}
 		cmd.SendId = topicContent.Initiator + skypeExt.NewUserSuffix
-		go portal.UpdateName(portalName, cmd.SendId)
+		go func() {
+			portal.UpdateName(portalName, cmd.SendId)
+			// The description has no update event of its own, so refresh it along with the topic
+			thread, err := user.Conn.GetThreadInfo(portal.Key.JID)
+			if err != nil {
+				user.log.Warnln("Failed to get group description:", err)
+			} else {
+				portal.UpdateDescription(thread.Properties.Description, cmd.SendId)
+			}
+			portal.Update()
+		}()
 	case skypeExt.ChatPictureUpdate:
 		topicContent := skype.ChatPictureContent{}
 		xml.Unmarshal([]byte(cmd.Content), &topicContent)
@@ -926,9 +1201,30 @@ func (user *User) HandleChatUpdate(cmd skype.Resource) {
 		go portal.membershipAdd(cmd.Content)
 	case skypeExt.ChatMemberDelete:
 		go portal.membershipRemove(cmd.Content)
+	case skypeExt.ChatRoleUpdate:
+		roleContent := skypeExt.ChatRoleUpdateContent{}
+		xml.Unmarshal([]byte(cmd.Content), &roleContent)
+		cmd.SendId = roleContent.Initiator + skypeExt.NewUserSuffix
+		go portal.HandleSkypeRoleUpdate(roleContent, cmd.SendId)
+	case skypeExt.ChatHistoryDisclosedUpdate:
+		propertyContent := skypeExt.ChatPropertyUpdateContent{}
+		xml.Unmarshal([]byte(cmd.Content), &propertyContent)
+		cmd.SendId = propertyContent.Initiator + skypeExt.NewUserSuffix
+		go portal.SetHistoryDisclosed(propertyContent.Value == "true", cmd.SendId)
+	case skypeExt.ChatJoiningEnabledUpdate:
+		propertyContent := skypeExt.ChatPropertyUpdateContent{}
+		xml.Unmarshal([]byte(cmd.Content), &propertyContent)
+		cmd.SendId = propertyContent.Initiator + skypeExt.NewUserSuffix
+		go portal.HandleSkypeJoiningEnabled(propertyContent.Value == "true", cmd.SendId)
+	case skypeExt.ChatPinnedMessage:
+		propertyContent := skypeExt.ChatPropertyUpdateContent{}
+		xml.Unmarshal([]byte(cmd.Content), &propertyContent)
+		cmd.SendId = propertyContent.Initiator + skypeExt.NewUserSuffix
+		go portal.HandleSkypePinnedMessage(propertyContent.Value, cmd.SendId)
 	case "":
 		if skypeExt.ChatActionType(cmd.Type) == skypeExt.ChatActionThread {
 			if len(cmd.ETag) > 0 && len(cmd.Properties.Capabilities) < 1 {
+				portal.handleRelayUserLeft(user.JID)
 				portal.Delete()
 				portal.Cleanup(false)
 			}
@@ -947,6 +1243,5 @@ func (user *User) HandleJsonMessage(message string) {
 }
 
 func (user *User) NeedsRelaybot(portal *Portal) bool {
-	return false
-	//return !user.HasSession() || !user.IsInPortal(portal.Key)
+	return user.Conn == nil || !user.Conn.LoggedIn || !user.IsInPortal(portal.Key)
 }